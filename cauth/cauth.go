@@ -14,9 +14,10 @@ import (
 
 // Config holds all config vars
 type Config struct {
-	CookieName   string `long:"cookie" default:"sfs_auth" description:"Auth cookie name"`
-	HeaderName   string `long:"header" default:"X-SFS-Auth" description:"Auth header name"`
-	CookieMaxAge int    `long:"cookie_ttl" default:"36000" description:"Auth cookie TTL"`
+	CookieName   string   `long:"cookie" default:"sfs_auth" description:"Auth cookie name"`
+	HeaderName   string   `long:"header" default:"X-SFS-Auth" description:"Auth header name"`
+	CookieMaxAge int      `long:"cookie_ttl" default:"36000" description:"Auth cookie TTL"`
+	Admins       []string `long:"admin" description:"Admin token (may be given several times)"`
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
@@ -31,18 +32,45 @@ var (
 	ErrNoAnyFile = errors.New("field 'file' does not contains any item")
 	// ErrNoAuth returned on Internal Server Error (no auth for upload)
 	ErrNoAuth = errors.New("This endpoint must be under AuthRequired")
+	// ErrNotAdmin returned when user token is not in admin list
+	ErrNotAdmin = errors.New("This endpoint is for admins only")
 )
 
+// ProfileFunc returns profile field value for user token
+type ProfileFunc func(token string) (interface{}, error)
+
 // Service holds upload service
 type Service struct {
 	Config     *Config
 	Log        *log.SugaredLogger
 	ContextKey string
+	admins     map[string]bool
+	profile    map[string]ProfileFunc
 }
 
 // New creates an Service object
 func New(cfg Config, logger *log.SugaredLogger, key string) *Service {
-	return &Service{&cfg, logger, key}
+	admins := map[string]bool{}
+	for _, token := range cfg.Admins {
+		admins[token] = true
+	}
+	return &Service{
+		Config:     &cfg,
+		Log:        logger,
+		ContextKey: key,
+		admins:     admins,
+		profile:    map[string]ProfileFunc{},
+	}
+}
+
+// AddProfileField adds field to /api/profile response
+func (srv Service) AddProfileField(name string, fn ProfileFunc) {
+	srv.profile[name] = fn
+}
+
+// IsAdmin returns true if token is in admin list
+func (srv Service) IsAdmin(token string) bool {
+	return srv.admins[token]
 }
 
 func (srv Service) SetupRouter(r *gin.Engine) {
@@ -99,6 +127,32 @@ func (srv Service) Profile() func(c *gin.Context) {
 		}
 		token := tokenIface.(string)
 		srv.Log.Debugw("Got user token", "token", token)
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		rv := gin.H{"token": token}
+		for name, fn := range srv.profile {
+			v, err := fn(token)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			rv[name] = v
+		}
+		c.JSON(http.StatusOK, rv)
+	}
+}
+
+// AdminRequired is a middleware which allows admin tokens only.
+// It must be used after AuthRequired
+func (srv Service) AdminRequired() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokenIface, _ := c.Get(srv.ContextKey)
+		if tokenIface == nil {
+			c.AbortWithError(http.StatusInternalServerError, ErrNoAuth)
+			return
+		}
+		if !srv.IsAdmin(tokenIface.(string)) {
+			c.AbortWithError(http.StatusForbidden, ErrNotAdmin)
+			return
+		}
+		c.Next()
 	}
 }
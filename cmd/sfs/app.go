@@ -26,6 +26,13 @@ type Config struct {
 	Stream      stream.Config  `group:"WS stream Options" namespace:"ws"`
 	PubSub      pubsub.Config  `group:"PuSub Options" namespace:"ps"`
 	Widget      widget.Config  `group:"Widget Options" namespace:"wg"`
+
+	Backup  BackupCommand  `command:"backup" description:"Save store snapshot to file (server must be stopped)"`
+	Restore RestoreCommand `command:"restore" description:"Load store snapshot from file (server must be stopped)"`
+	Reshard ReshardCommand `command:"reshard" description:"Move files to layout from config (server must be stopped)"`
+
+	// command holds name of given command if any
+	command string
 }
 
 const (
@@ -47,8 +54,19 @@ func run(exitFunc func(code int)) {
 	l := setupLog(cfg, router)
 	defer l.Sync()
 
-	pubsubService := pubsub.New(cfg.PubSub, l)
+	if cfg.command != "" {
+		err = runCommand(cfg, l)
+		return
+	}
+
+	var pubsubService *pubsub.Service
+	pubsubService, err = pubsub.New(cfg.PubSub, l)
+	if err != nil {
+		return
+	}
 	defer pubsubService.Close()
+	// storage publishes events about recovered files on start
+	go pubsubService.Run()
 	streamService := stream.New(cfg.Stream, l, pubsubService, ContextAuthKey)
 
 	var store *storage.Service
@@ -60,13 +78,15 @@ func run(exitFunc func(code int)) {
 
 	widgetService := widget.New(cfg.Widget, l, pubsubService, ContextAuthKey, ContextRequestKey)
 
-	go pubsubService.Run()
 	go store.HandlersRun()
 	defer store.HandlersClose()
 	go widgetService.HandlersRun()
 	defer widgetService.HandlersClose()
 
 	authService := cauth.New(cfg.CAuth, l, ContextAuthKey)
+	authService.AddProfileField("stats", func(token string) (interface{}, error) {
+		return store.UserStats(token)
+	})
 	sfsService := sfs.New(cfg.SFS, l, store, ContextAuthKey)
 
 	// Set a lower memory limit for multipart forms (default is 32 MiB)
@@ -77,11 +97,16 @@ func run(exitFunc func(code int)) {
 	router.StaticFile("/", filepath.Join(cfg.AssetPath, "index.html"))
 	router.GET("/debug/vars", expvar.Handler())
 
-	streamService.SetupRouter(router)
 	authService.SetupRouter(router)
+	streamService.SetupRouter(router)
 	sfsService.SetupRouter(router)
 	widgetService.SetupRouter(router)
 
+	// admin group must be created after AuthRequired setup
+	admin := router.Group("/", authService.AdminRequired())
+	sfsService.SetupAdminRouter(admin)
+	streamService.SetupAdminRouter(admin)
+
 	router.Run(cfg.Listen)
 
 }
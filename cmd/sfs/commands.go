@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	log "go.uber.org/zap"
+
+	"github.com/LeKovr/sfs/pubsub"
+	"github.com/LeKovr/sfs/storage"
+)
+
+// BackupCommand holds backup command args
+type BackupCommand struct {
+	Out   string `long:"out" required:"true" description:"Backup archive file"`
+	Since uint64 `long:"since" description:"Save changes since this version only (printed by previous backup)"`
+}
+
+// RestoreCommand holds restore command args
+type RestoreCommand struct {
+	In    string `long:"in" required:"true" description:"Backup archive file"`
+	Force bool   `long:"force" description:"Remove existing store content before restore"`
+}
+
+// ReshardCommand holds reshard command args
+type ReshardCommand struct{}
+
+// ErrUnknownCommand returned if command is not implemented
+var ErrUnknownCommand = errors.New("unknown command")
+
+// runCommand runs offline store command
+func runCommand(cfg *Config, l *log.SugaredLogger) error {
+	// scheduled messages are sent by server only
+	cfg.PubSub.NoSchedule = true
+	pubsubService, err := pubsub.New(cfg.PubSub, l)
+	if err != nil {
+		return err
+	}
+	defer pubsubService.Close()
+	go pubsubService.Run()
+
+	store, err := storage.New(cfg.Store, l, pubsubService)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch cfg.command {
+	case "backup":
+		return backup(cfg.Backup, store, l)
+	case "restore":
+		return restore(cfg.Restore, store, l)
+	case "reshard":
+		moved, err := store.Reshard()
+		if err != nil {
+			return err
+		}
+		l.Infow("Files moved", "count", moved)
+		return nil
+	}
+	return ErrUnknownCommand
+}
+
+func backup(cmd BackupCommand, store *storage.Service, l *log.SugaredLogger) error {
+	f, err := os.Create(cmd.Out)
+	if err != nil {
+		return err
+	}
+	info, err := store.Backup(f, cmd.Since)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(cmd.Out)
+		return err
+	}
+	l.Infow("Backup saved", "file", cmd.Out, "files", info.Files, "since", info.Since, "next", info.Next)
+	return nil
+}
+
+func restore(cmd RestoreCommand, store *storage.Service, l *log.SugaredLogger) error {
+	f, err := os.Open(cmd.In)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := store.Restore(f, cmd.Force)
+	if err != nil {
+		return err
+	}
+	l.Infow("Backup restored", "file", cmd.In, "since", info.Since, "created", info.CreatedAt)
+	return nil
+}
@@ -23,6 +23,7 @@ var (
 func setupConfig(args ...string) (*Config, error) {
 	cfg := &Config{}
 	p := flags.NewParser(cfg, flags.Default) //  HelpFlag | PrintErrors | PassDoubleDash
+	p.SubcommandsOptional = true
 	var err error
 	if len(args) == 0 {
 		_, err = p.Parse()
@@ -36,6 +37,9 @@ func setupConfig(args ...string) (*Config, error) {
 		}
 		return nil, ErrBadArgs
 	}
+	if p.Active != nil {
+		cfg.command = p.Active.Name
+	}
 	return cfg, nil
 }
 
@@ -15,7 +15,10 @@ require (
 	github.com/jessevdk/go-flags v1.6.1
 	github.com/mattn/go-colorable v0.1.14
 	github.com/stretchr/testify v1.11.1
+	github.com/ugorji/go/codec v1.3.0
 	go.uber.org/zap v1.27.1
+	golang.org/x/sys v0.38.0
+	google.golang.org/protobuf v1.36.9
 )
 
 require (
@@ -48,13 +51,10 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/quic-go/qpack v0.6.0 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
-	github.com/ugorji/go/codec v1.3.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/arch v0.20.0 // indirect
 	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
-	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
-	google.golang.org/protobuf v1.36.9 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Action is the topic operation checked by Authorizer
+type Action string
+
+// Topic actions
+const (
+	ActionSubscribe Action = "sub"
+	ActionPublish   Action = "pub"
+)
+
+// PrincipalVar is replaced by principal ID in rule pattern
+const PrincipalVar = "{principal}"
+
+var (
+	// ErrForbidden is wrapped by AuthError
+	ErrForbidden = errors.New("forbidden")
+	// ErrBadRule returned when rule is not in form role:action:pattern
+	ErrBadRule = errors.New("bad rule")
+)
+
+// Principal holds identity of pubsub client
+type Principal struct {
+	ID   string
+	Role string
+}
+
+// principalKey is the context key of Principal
+type principalKey struct{}
+
+// WithPrincipal returns context with principal.
+// Calls with context without principal are not checked
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns principal stored in context
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// AuthError returned when principal is not allowed to act on topic
+type AuthError struct {
+	Principal Principal
+	Action    Action
+	Topic     string
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("%s: %s (%s) may not %s %s", ErrForbidden, e.Principal.ID, e.Principal.Role, e.Action, e.Topic)
+}
+
+// Unwrap allows errors.Is(err, ErrForbidden)
+func (e AuthError) Unwrap() error {
+	return ErrForbidden
+}
+
+// Authorizer checks if principal may act on topic
+type Authorizer interface {
+	Authorize(p Principal, action Action, topic string) error
+}
+
+// Rule allows action on topics covered by pattern for role.
+// Role and Action may be "*"
+type Rule struct {
+	Role    string
+	Action  Action
+	Pattern string
+}
+
+// Rules is the Authorizer which allows actions matching any rule
+type Rules []Rule
+
+// ParseRules parses rules in form role:action:pattern, e.g. "user:sub:user.{principal}"
+func ParseRules(specs []string) (Rules, error) {
+	var rv Rules
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrBadRule, spec)
+		}
+		action := Action(parts[1])
+		if action != ActionSubscribe && action != ActionPublish && action != "*" {
+			return nil, fmt.Errorf("%w: unknown action in %q", ErrBadRule, spec)
+		}
+		if err := ValidPattern(parts[2]); err != nil {
+			return nil, fmt.Errorf("%w: %q", err, spec)
+		}
+		rv = append(rv, Rule{parts[0], action, parts[2]})
+	}
+	return rv, nil
+}
+
+// Authorize returns AuthError if no rule allows action
+func (rules Rules) Authorize(p Principal, action Action, topic string) error {
+	for _, r := range rules {
+		if (r.Role != "*" && r.Role != p.Role) || (r.Action != "*" && r.Action != action) {
+			continue
+		}
+		pattern := r.Pattern
+		if strings.Contains(pattern, PrincipalVar) {
+			if p.ID == "" || strings.ContainsAny(p.ID, ".*>") {
+				continue
+			}
+			pattern = strings.ReplaceAll(pattern, PrincipalVar, p.ID)
+		}
+		if Covers(pattern, topic) {
+			return nil
+		}
+	}
+	return AuthError{p, action, topic}
+}
+
+// SetAuthorizer sets authorizer used for calls with principal in context
+func (srv *Service) SetAuthorizer(a Authorizer) {
+	srv.auth = a
+}
+
+// authorize checks principal from ctx if it is set
+func (srv Service) authorize(ctx context.Context, action Action, topic string) error {
+	p, ok := PrincipalFrom(ctx)
+	if !ok || srv.auth == nil {
+		return nil
+	}
+	if err := srv.auth.Authorize(p, action, topic); err != nil {
+		srv.Log.Warnw("Access denied", "principal", p.ID, "role", p.Role, "action", action, "topic", topic)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec names
+const (
+	CodecJSON     = "json"
+	CodecMsgPack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+var (
+	// ErrUnknownCodec returned when codec is not registered
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrNotProto returned when protobuf codec gets value which is not proto.Message
+	ErrNotProto = errors.New("value is not proto.Message")
+)
+
+// Codec encodes message payloads
+type Codec interface {
+	// Name is stored in Message.Codec
+	Name() string
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codecs holds registered codecs by name
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	CodecJSON:     JSON{},
+	CodecMsgPack:  MsgPack{},
+	CodecProtobuf: Protobuf{},
+}}
+
+// RegisterCodec adds codec to registry, codec with the same name is replaced
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.Name()] = c
+}
+
+// CodecByName returns registered codec, JSON for empty name
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		name = CodecJSON
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// CodecNames returns sorted names of registered codecs
+func CodecNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	rv := make([]string, 0, len(codecs.m))
+	for name := range codecs.m {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Decode decodes message payload with message codec
+func Decode(m Message, v interface{}) error {
+	c, err := CodecByName(m.Codec)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(m.Payload, v)
+}
+
+// Transcode returns message payload encoded by codec.
+// Payload is decoded into interface{}, so protobuf payloads can not be transcoded
+func Transcode(m Message, to Codec) ([]byte, error) {
+	if m.Codec == to.Name() || (m.Codec == "" && to.Name() == CodecJSON) {
+		return m.Payload, nil
+	}
+	var v interface{}
+	if err := Decode(m, &v); err != nil {
+		return nil, err
+	}
+	return to.Marshal(v)
+}
+
+// JSON is the default codec
+type JSON struct{}
+
+func (JSON) Name() string        { return CodecJSON }
+func (JSON) ContentType() string { return "application/json" }
+
+func (JSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackHandle decodes maps as map[string]interface{} to be JSON compatible
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true}
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+	return h
+}()
+
+// MsgPack encodes payload as MessagePack, struct fields are named by json tags
+type MsgPack struct{}
+
+func (MsgPack) Name() string        { return CodecMsgPack }
+func (MsgPack) ContentType() string { return "application/msgpack" }
+
+func (MsgPack) Marshal(v interface{}) (b []byte, err error) {
+	err = codec.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+	return
+}
+
+func (MsgPack) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+// Protobuf encodes proto.Message values
+type Protobuf struct{}
+
+func (Protobuf) Name() string        { return CodecProtobuf }
+func (Protobuf) ContentType() string { return "application/x-protobuf" }
+
+func (Protobuf) Marshal(v interface{}) ([]byte, error) {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProto
+	}
+	return proto.Marshal(pm)
+}
+
+// Unmarshal decodes into proto.Message or into pointer to proto.Message pointer
+func (Protobuf) Unmarshal(data []byte, v interface{}) error {
+	if pm, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, pm)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Pointer {
+		return ErrNotProto
+	}
+	nv := reflect.New(rv.Elem().Type().Elem())
+	pm, ok := nv.Interface().(proto.Message)
+	if !ok {
+		return ErrNotProto
+	}
+	if err := proto.Unmarshal(data, pm); err != nil {
+		return err
+	}
+	rv.Elem().Set(nv)
+	return nil
+}
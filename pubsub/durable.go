@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Durable log keys
+const (
+	// logPrefix + topic + "\x00" + offset (uint64 BE) holds message
+	logPrefix = "ps.log."
+	// seqPrefix + topic holds last topic offset
+	seqPrefix = "ps.seq."
+
+	// metaCodec is set in entry user meta when value is codec name + "\x00" + payload (previous versions)
+	metaCodec byte = 1
+	// metaEnvelope is set in entry user meta when value is json encoded storedMessage
+	metaEnvelope byte = 2
+)
+
+// SubscribeOption sets subscription options
+type SubscribeOption func(*Stream)
+
+// FromLatest subscribes on new messages only (default)
+func FromLatest() SubscribeOption {
+	return func(s *Stream) { s.from = 0 }
+}
+
+// FromEarliest replays all kept messages of durable topics
+func FromEarliest() SubscribeOption {
+	return func(s *Stream) { s.from = 1 }
+}
+
+// FromOffset replays kept messages of durable topics starting from offset
+func FromOffset(offset uint64) SubscribeOption {
+	return func(s *Stream) {
+		s.from = offset
+		if offset == 0 {
+			s.from = 1
+		}
+	}
+}
+
+// openLog opens db of durable topics and scheduled messages if data path or durable topics are set
+func openLog(cfg Config) (*badger.DB, error) {
+	if len(cfg.Durable) == 0 && cfg.DataPath == "" {
+		return nil, nil
+	}
+	opts := badger.DefaultOptions(cfg.DataPath).WithLogger(nil)
+	if cfg.DataPath == "" {
+		opts = opts.WithInMemory(true)
+	}
+	return badger.Open(opts)
+}
+
+// logKey returns db key of topic message
+func logKey(topic string, offset uint64) []byte {
+	key := make([]byte, 0, len(logPrefix)+len(topic)+9)
+	key = append(key, logPrefix...)
+	key = append(key, topic...)
+	key = append(key, 0)
+	return binary.BigEndian.AppendUint64(key, offset)
+}
+
+// isDurable returns true if topic messages are logged
+func (srv Service) isDurable(topic string) bool {
+	if srv.db == nil {
+		return false
+	}
+	for _, p := range srv.Config.Durable {
+		if Match(p, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendLog saves message in topic log and returns its offset
+func (srv Service) appendLog(m Message) (offset uint64, err error) {
+	err = srv.db.Update(func(txn *badger.Txn) error {
+		seqKey := []byte(seqPrefix + m.Topic)
+		item, err := txn.Get(seqKey)
+		if err == nil {
+			err = item.Value(func(v []byte) error {
+				offset = binary.BigEndian.Uint64(v)
+				return nil
+			})
+		} else if err == badger.ErrKeyNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		offset++
+		value, err := json.Marshal(newStoredMessage(m, false))
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(logKey(m.Topic, offset), value).WithMeta(metaEnvelope)
+		if srv.Config.RetainAge > 0 {
+			e = e.WithTTL(srv.Config.RetainAge)
+		}
+		if err = txn.SetEntry(e); err != nil {
+			return err
+		}
+		if n := uint64(srv.Config.RetainCount); n > 0 && offset > n {
+			if err = txn.Delete(logKey(m.Topic, offset-n)); err != nil {
+				return err
+			}
+		}
+		return txn.Set(seqKey, binary.BigEndian.AppendUint64(nil, offset))
+	})
+	return
+}
+
+// backlog returns kept messages of topics matching pattern starting from offset
+func (srv Service) backlog(pattern string, from uint64) (rv []Message, err error) {
+	err = srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix, start := []byte(logPrefix), []byte(logPrefix)
+		if !IsPattern(pattern) {
+			start = logKey(pattern, from)
+			prefix = start[:len(start)-8]
+		}
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			topic := string(key[len(logPrefix) : len(key)-9])
+			offset := binary.BigEndian.Uint64(key[len(key)-8:])
+			if offset < from || !Match(pattern, topic) {
+				continue
+			}
+			payload, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			m := Message{Topic: topic, Payload: payload}
+			switch meta := it.Item().UserMeta(); {
+			case meta&metaEnvelope != 0:
+				var sm storedMessage
+				if err = json.Unmarshal(payload, &sm); err != nil {
+					return err
+				}
+				m = sm.message(topic)
+			case meta&metaCodec != 0:
+				if i := bytes.IndexByte(payload, 0); i >= 0 {
+					m.Codec, m.Payload = string(payload[:i]), payload[i+1:]
+				}
+			}
+			m.Offset = offset
+			rv = append(rv, m)
+		}
+		return nil
+	})
+	return
+}
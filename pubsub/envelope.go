@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+)
+
+// Message headers
+const (
+	// HeaderRequestID holds ID of http request which caused message
+	HeaderRequestID = "X-Request-ID"
+	// HeaderTraceParent holds W3C trace context
+	HeaderTraceParent = "traceparent"
+)
+
+// headersKey is the context key of message headers
+type headersKey struct{}
+
+// WithHeader returns context with header added to headers of messages published with it
+func WithHeader(ctx context.Context, key, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+	return WithHeaders(ctx, map[string]string{key: value})
+}
+
+// WithHeaders returns context with headers added to headers of messages published with it
+func WithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	rv := HeadersFrom(ctx)
+	if rv == nil {
+		rv = make(map[string]string, len(headers))
+	}
+	for k, v := range headers {
+		rv[k] = v
+	}
+	return context.WithValue(ctx, headersKey{}, rv)
+}
+
+// HeadersFrom returns copy of headers stored in context
+func HeadersFrom(ctx context.Context) map[string]string {
+	h, _ := ctx.Value(headersKey{}).(map[string]string)
+	if len(h) == 0 {
+		return nil
+	}
+	rv := make(map[string]string, len(h))
+	for k, v := range h {
+		rv[k] = v
+	}
+	return rv
+}
+
+// envelope sets message ID, time, publisher and headers if they are not set
+func (srv Service) envelope(ctx context.Context, m *Message) error {
+	if m.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		m.ID = id
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	if m.Publisher == "" {
+		m.Publisher = srv.Config.Name
+		if p, ok := PrincipalFrom(ctx); ok {
+			m.Publisher = p.ID
+		}
+	}
+	if m.Headers == nil {
+		m.Headers = HeadersFrom(ctx)
+	}
+	return nil
+}
+
+// storedMessage is the message encoding in db and redis channel
+type storedMessage struct {
+	Topic     string            `json:"topic,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
+	Reply     string            `json:"reply,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Codec     string            `json:"codec,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Time      time.Time         `json:"time"`
+	Publisher string            `json:"publisher,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// newStoredMessage returns message encoding, topic is set if withTopic is true
+func newStoredMessage(m Message, withTopic bool) storedMessage {
+	rv := storedMessage{"", m.Payload, m.Reply, m.Error, m.Codec, m.ID, m.Time, m.Publisher, m.Headers}
+	if withTopic {
+		rv.Topic = m.Topic
+	}
+	return rv
+}
+
+// message returns decoded message
+func (sm storedMessage) message(topic string) Message {
+	if topic == "" {
+		topic = sm.Topic
+	}
+	return Message{Topic: topic, Payload: sm.Payload, Reply: sm.Reply, Error: sm.Error, Codec: sm.Codec,
+		ID: sm.ID, Time: sm.Time, Publisher: sm.Publisher, Headers: sm.Headers}
+}
@@ -0,0 +1,228 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// deadPrefix + id holds dead letter
+const deadPrefix = "ps.dead."
+
+// ErrNoDeadLetter returned when dead letter is not found
+var ErrNoDeadLetter = errors.New("dead letter not found")
+
+// DeadLetter holds message which handler failed to process
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Payload  []byte    `json:"payload,omitempty"`
+	Codec    string    `json:"codec,omitempty"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+	// Message holds failed message envelope
+	MessageID string            `json:"message_id,omitempty"`
+	Publisher string            `json:"publisher,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// permanentError holds error which must not be retried
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// attemptKey is the context key of handler attempt number
+type attemptKey struct{}
+
+// lastAttempt holds handler attempt state
+type lastAttempt bool
+
+// LastAttempt returns false if handler error will be retried.
+// It returns true when ctx is not the handler context
+func LastAttempt(ctx context.Context) bool {
+	last, ok := ctx.Value(attemptKey{}).(lastAttempt)
+	return !ok || bool(last)
+}
+
+// Permanent wraps handler error to send message to dead letters without retries
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Handle runs handler for every message of topic until ctx is done or hub is closed.
+// Messages are processed concurrently. Failed handler is retried Config.Retries times
+// with exponential backoff, then message is kept as dead letter. Messages which cannot be decoded
+// are not retried
+func Handle[T any](ctx context.Context, srv *Service, topic string,
+	handler func(context.Context, Event[T]) error, opts ...SubscribeOption) error {
+	s, err := srv.Subscribe(ctx, topic, opts...)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer s.Unsubscribe()
+	for m := range s.Messages {
+		wg.Add(1)
+		go func(m Message) {
+			defer wg.Done()
+			srv.handle(ctx, m, func(ctx context.Context) error {
+				ev := newEvent[T](m)
+				if err := Decode(m, &ev.Value); err != nil {
+					return Permanent(err)
+				}
+				return handler(ctx, ev)
+			})
+		}(m)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrClosed
+}
+
+// handle calls fn with retries and keeps message as dead letter on fail.
+// Message headers are added to fn context, so they are propagated to messages published by handler
+func (srv Service) handle(ctx context.Context, m Message, fn func(context.Context) error) {
+	ctx = WithHeaders(ctx, m.Headers)
+	delay := srv.Config.RetryDelay
+	attempt := 1
+	call := func() error {
+		last := lastAttempt(attempt > srv.Config.Retries)
+		return fn(context.WithValue(ctx, attemptKey{}, last))
+	}
+	err := call()
+	for err != nil && attempt <= srv.Config.Retries {
+		var perm permanentError
+		if errors.As(err, &perm) {
+			break
+		}
+		srv.Log.Warnw("Handler error", "topic", m.Topic, "id", m.ID, "attempt", attempt, "error", err)
+		srv.count("retried", m.Topic, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			srv.Log.Warnw("Handler canceled", "topic", m.Topic, "error", err)
+			return
+		}
+		if delay *= 2; srv.Config.RetryMaxDelay > 0 && delay > srv.Config.RetryMaxDelay {
+			delay = srv.Config.RetryMaxDelay
+		}
+		attempt++
+		err = call()
+	}
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		srv.Log.Warnw("Handler canceled", "topic", m.Topic, "error", err)
+		return
+	}
+	srv.Log.Errorw("Handler failed", "topic", m.Topic, "id", m.ID, "request", m.Headers[HeaderRequestID], "attempts", attempt, "error", err)
+	srv.count("dead", m.Topic, 1)
+	if err = srv.addDeadLetter(ctx, m, attempt, err); err != nil {
+		srv.Log.Errorw("Dead letter save error", "topic", m.Topic, "error", err)
+	}
+}
+
+// addDeadLetter saves failed message and notifies DeadTopic subscribers
+func (srv Service) addDeadLetter(ctx context.Context, m Message, attempts int, failure error) error {
+	if srv.db == nil {
+		return ErrNoStore
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	dl := DeadLetter{id, m.Topic, m.Payload, m.Codec, failure.Error(), attempts, time.Now(), m.ID, m.Publisher, m.Headers}
+	value, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	err = srv.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(deadPrefix+id), value)
+	})
+	if err != nil || srv.Config.DeadTopic == "" {
+		return err
+	}
+	return srv.publish(ctx, Message{Topic: srv.Config.DeadTopic, Payload: value, Codec: CodecJSON})
+}
+
+// DeadLetters returns kept dead letters ordered by time
+func (srv Service) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	if srv.db == nil {
+		return nil, ErrNoStore
+	}
+	rv := []DeadLetter{}
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(deadPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var dl DeadLetter
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &dl)
+			})
+			if err != nil {
+				return err
+			}
+			rv = append(rv, dl)
+		}
+		return nil
+	})
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Time.Before(rv[j].Time) })
+	return rv, err
+}
+
+// Replay publishes dead letter message to its topic again and removes dead letter
+func (srv Service) Replay(ctx context.Context, id string) error {
+	dl, err := srv.takeDeadLetter(id, false)
+	if err != nil {
+		return err
+	}
+	m := Message{Topic: dl.Topic, Payload: dl.Payload, Codec: dl.Codec, ID: dl.MessageID, Publisher: dl.Publisher, Headers: dl.Headers}
+	if err = srv.publish(ctx, m); err != nil {
+		return err
+	}
+	_, err = srv.takeDeadLetter(id, true)
+	return err
+}
+
+// DeleteDeadLetter removes dead letter
+func (srv Service) DeleteDeadLetter(ctx context.Context, id string) error {
+	_, err := srv.takeDeadLetter(id, true)
+	return err
+}
+
+// takeDeadLetter loads dead letter and removes it if remove is set
+func (srv Service) takeDeadLetter(id string, remove bool) (dl DeadLetter, err error) {
+	if srv.db == nil {
+		return dl, ErrNoStore
+	}
+	err = srv.db.Update(func(txn *badger.Txn) error {
+		key := []byte(deadPrefix + id)
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return ErrNoDeadLetter
+		} else if err != nil {
+			return err
+		}
+		err = item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &dl)
+		})
+		if err != nil || !remove {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	return
+}
@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OtherPrefix is the metrics prefix of topics without configured prefix
+const OtherPrefix = "other"
+
+// infoTimeout limits hub info request from expvar
+const infoTimeout = time.Second
+
+var (
+	// metrics holds hub counters, totals and by topic prefix
+	metrics = expvar.NewMap("pubsub")
+	// topicMetrics holds counters by topic prefix
+	topicMetrics = new(expvar.Map).Init()
+	// topicMetricsLock guards prefix maps creation
+	topicMetricsLock sync.Mutex
+)
+
+func init() {
+	metrics.Set("topics", topicMetrics)
+}
+
+// TopicInfo holds subscribed topic state
+type TopicInfo struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+	// Depth holds count of messages waiting in subscriber buffers
+	Depth int `json:"depth"`
+}
+
+// BufferInfo holds once.* topic buffer state
+type BufferInfo struct {
+	Topic    string `json:"topic"`
+	Messages int    `json:"messages"`
+	Bytes    int    `json:"bytes"`
+}
+
+// PrefixInfo holds gauges of topics with common prefix
+type PrefixInfo struct {
+	Subscribers int `json:"subscribers"`
+	Depth       int `json:"depth"`
+	Buffered    int `json:"buffered"`
+}
+
+// HubInfo holds hub state
+type HubInfo struct {
+	Topics  []TopicInfo           `json:"topics"`
+	Buffers []BufferInfo          `json:"buffers"`
+	Clients int                   `json:"clients"`
+	Queue   int                   `json:"queue"`
+	Gauges  map[string]PrefixInfo `json:"gauges"`
+}
+
+// topicPrefix returns longest configured prefix of topic
+func (srv Service) topicPrefix(topic string) string {
+	rv := OtherPrefix
+	size := 0
+	for _, p := range srv.Config.MetricPrefixes {
+		if len(p) > size && (topic == p || strings.HasSuffix(p, ".") && strings.HasPrefix(topic, p)) {
+			rv, size = p, len(p)
+		}
+	}
+	return rv
+}
+
+// count adds n to counter total and to counter of topic prefix
+func (srv Service) count(name, topic string, n int64) {
+	if n == 0 {
+		return
+	}
+	metrics.Add(name, n)
+	prefix := srv.topicPrefix(topic)
+	m, ok := topicMetrics.Get(prefix).(*expvar.Map)
+	if !ok {
+		topicMetricsLock.Lock()
+		if m, ok = topicMetrics.Get(prefix).(*expvar.Map); !ok {
+			m = new(expvar.Map).Init()
+			topicMetrics.Set(prefix, m)
+		}
+		topicMetricsLock.Unlock()
+	}
+	m.Add(name, n)
+}
+
+// Info returns hub state
+func (srv Service) Info(ctx context.Context) (*HubInfo, error) {
+	reply := make(chan *HubInfo, 1)
+	select {
+	case srv.info <- reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-srv.quit:
+		return nil, ErrClosed
+	}
+	select {
+	case info := <-reply:
+		return info, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// hubInfo collects hub state, called by Run
+func (srv Service) hubInfo(subscribers map[string]map[chan Message]bool, clients int, buffers *onceBuffers) *HubInfo {
+	info := &HubInfo{Clients: clients, Queue: len(srv.local.ch), Gauges: map[string]PrefixInfo{}}
+	for topic, subs := range subscribers {
+		ti := TopicInfo{Topic: topic, Subscribers: len(subs)}
+		for c := range subs {
+			ti.Depth += len(c)
+		}
+		info.Topics = append(info.Topics, ti)
+		g := info.Gauges[srv.topicPrefix(topic)]
+		g.Subscribers += ti.Subscribers
+		g.Depth += ti.Depth
+		info.Gauges[srv.topicPrefix(topic)] = g
+	}
+	for topic, t := range buffers.topics {
+		bi := BufferInfo{Topic: topic, Messages: len(t.Messages)}
+		for _, m := range t.Messages {
+			bi.Bytes += len(m.Payload)
+		}
+		info.Buffers = append(info.Buffers, bi)
+		g := info.Gauges[srv.topicPrefix(topic)]
+		g.Buffered += bi.Messages
+		info.Gauges[srv.topicPrefix(topic)] = g
+	}
+	sort.Slice(info.Topics, func(i, j int) bool { return info.Topics[i].Topic < info.Topics[j].Topic })
+	sort.Slice(info.Buffers, func(i, j int) bool { return info.Buffers[i].Topic < info.Buffers[j].Topic })
+	return info
+}
+
+// publishExpvar shows gauges of service in /debug/vars
+func (srv Service) publishExpvar() {
+	metrics.Set("gauges", expvar.Func(func() interface{} {
+		ctx, cancel := context.WithTimeout(context.Background(), infoTimeout)
+		defer cancel()
+		info, err := srv.Info(ctx)
+		if err != nil {
+			return err.Error()
+		}
+		return info.Gauges
+	}))
+}
@@ -0,0 +1,147 @@
+package pubsub
+
+import (
+	"time"
+)
+
+// onceMessage holds buffered message and its arrival time
+type onceMessage struct {
+	Message
+	At time.Time
+}
+
+// onceTopic holds buffered messages of topic
+type onceTopic struct {
+	Messages []onceMessage
+	seq      uint64
+}
+
+// onceEntry is the topic reference in buffers order
+type onceEntry struct {
+	Topic string
+	seq   uint64
+}
+
+// onceBuffers holds messages of once.* topics published without subscribers
+type onceBuffers struct {
+	ttl      time.Duration
+	maxLen   int
+	maxBytes int
+	topics   map[string]*onceTopic
+	// topics in order of creation, may hold removed topics
+	order []onceEntry
+	// stale holds count of removed topics in order
+	stale int
+	seq   uint64
+	bytes int
+	// count updates metrics
+	count func(name, topic string, n int64)
+}
+
+func newOnceBuffers(cfg Config, count func(name, topic string, n int64)) *onceBuffers {
+	return &onceBuffers{
+		ttl:      cfg.OnceTTL,
+		maxLen:   cfg.OnceMaxLen,
+		maxBytes: cfg.OnceMaxBytes,
+		topics:   map[string]*onceTopic{},
+		count:    count,
+	}
+}
+
+// add saves message and evicts oldest messages if buffers are over limits
+func (b *onceBuffers) add(m Message, now time.Time) {
+	t, ok := b.topics[m.Topic]
+	if !ok {
+		b.seq++
+		t = &onceTopic{seq: b.seq}
+		b.topics[m.Topic] = t
+		b.order = append(b.order, onceEntry{m.Topic, b.seq})
+	}
+	t.Messages = append(t.Messages, onceMessage{m, now})
+	b.bytes += len(m.Payload)
+	b.count("buffered", m.Topic, 1)
+	if b.maxLen > 0 && len(t.Messages) > b.maxLen {
+		b.count("once_evicted", m.Topic, int64(b.drop(m.Topic, len(t.Messages)-b.maxLen)))
+	}
+	for b.maxBytes > 0 && b.bytes > b.maxBytes && len(b.order) > 0 {
+		e := b.order[0]
+		if t, ok := b.topics[e.Topic]; !ok || t.seq != e.seq {
+			b.order = b.order[1:]
+			b.stale--
+			continue
+		}
+		b.count("once_evicted", e.Topic, int64(b.drop(e.Topic, 1)))
+	}
+}
+
+// drop removes n oldest messages of topic and returns n.
+// Order is compacted when most of its topics are removed
+func (b *onceBuffers) drop(topic string, n int) int {
+	t := b.topics[topic]
+	for _, m := range t.Messages[:n] {
+		b.bytes -= len(m.Payload)
+	}
+	if n == len(t.Messages) {
+		delete(b.topics, topic)
+		if b.stale++; b.stale > len(b.order)/2 {
+			b.compact()
+		}
+	} else {
+		t.Messages = t.Messages[n:]
+	}
+	return n
+}
+
+// expired returns count of topic messages which are expired at now
+func (b *onceBuffers) expired(t *onceTopic, now time.Time) int {
+	if b.ttl <= 0 {
+		return 0
+	}
+	n := 0
+	for n < len(t.Messages) && now.Sub(t.Messages[n].At) > b.ttl {
+		n++
+	}
+	return n
+}
+
+// take removes and returns not expired messages of topics matching pattern
+func (b *onceBuffers) take(pattern string, now time.Time) (rv []Message) {
+	for topic, t := range b.topics {
+		if !Match(pattern, topic) {
+			continue
+		}
+		if n := b.expired(t, now); n > 0 {
+			b.count("once_expired", topic, int64(b.drop(topic, n)))
+			if _, ok := b.topics[topic]; !ok {
+				continue
+			}
+		}
+		for _, m := range t.Messages {
+			rv = append(rv, m.Message)
+		}
+		b.drop(topic, len(t.Messages))
+	}
+	return
+}
+
+// sweep removes expired messages and compacts topics order
+func (b *onceBuffers) sweep(now time.Time) {
+	for topic, t := range b.topics {
+		if n := b.expired(t, now); n > 0 {
+			b.count("once_expired", topic, int64(b.drop(topic, n)))
+		}
+	}
+	b.compact()
+}
+
+// compact removes deleted topics from order
+func (b *onceBuffers) compact() {
+	order := b.order[:0]
+	for _, e := range b.order {
+		if t, ok := b.topics[e.Topic]; ok && t.seq == e.seq {
+			order = append(order, e)
+		}
+	}
+	b.order = order
+	b.stale = 0
+}
@@ -2,11 +2,17 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	//	"fmt"
 
+	badger "github.com/dgraph-io/badger/v2"
 	log "go.uber.org/zap"
 )
 
@@ -17,10 +23,59 @@ type Config struct {
 	CookieName   string `long:"cookie" default:"sfs_auth" description:"Auth cookie name"`
 	HeaderName   string `long:"header" default:"X-SFS-Auth" description:"Auth header name"`
 	CookieMaxAge int    `long:"cookie_ttl" default:"3600" description:"Auth cookie TTL"`
+	BufferSize   int    `long:"buffer" default:"64" description:"Subscriber buffer size"`
+	QueueSize    int    `long:"queue" default:"1024" description:"Published messages queue size"`
+	Overflow     string `long:"overflow" default:"drop_oldest" choice:"drop_oldest" choice:"drop_newest" choice:"disconnect" description:"Slow subscriber policy"`
+
+	DataPath    string        `long:"data" default:"var/pubsub" description:"Durable topics, scheduled messages and dead letters DB path (in memory if empty)"`
+	Durable     []string      `long:"durable" default:"user.*" description:"Durable topic pattern"`
+	RetainAge   time.Duration `long:"retain_age" default:"24h" description:"Durable message TTL (0 - unlimited)"`
+	RetainCount int           `long:"retain_count" default:"1000" description:"Messages kept per durable topic (0 - unlimited)"`
+
+	OnceTTL      time.Duration `long:"once_ttl" default:"5m" description:"Buffered once.* message TTL (0 - unlimited)"`
+	OnceMaxLen   int           `long:"once_len" default:"100" description:"Buffered messages per once.* topic (0 - unlimited)"`
+	OnceMaxBytes int           `long:"once_bytes" default:"10485760" description:"Buffered once.* payload total size (0 - unlimited)"`
+	Sweep        time.Duration `long:"sweep" default:"30s" description:"Expired once.* messages removal period (0 - disabled)"`
+
+	RequestTimeout time.Duration `long:"request_timeout" default:"10s" description:"Request reply wait timeout (0 - ctx only)"`
+
+	Transport   string   `long:"transport" default:"memory" choice:"memory" choice:"redis" description:"Transport shared between sfs nodes"`
+	RedisAddr   string   `long:"redis" default:"localhost:6379" description:"Redis server address"`
+	RedisPrefix string   `long:"redis_prefix" default:"sfs." description:"Redis channel name prefix"`
+	Shared      []string `long:"shared" default:"user.*" default:"once.>" default:"admin" default:"_inbox.>" description:"Topic pattern published via transport"`
+
+	MetricPrefixes []string `long:"metric_prefix" default:"user." default:"once.widget." default:"file" default:"widget" default:"admin" default:"_inbox." description:"Topic prefix for metrics"`
+
+	Retries       int           `long:"retries" default:"3" description:"Handler retries before dead letter"`
+	RetryDelay    time.Duration `long:"retry_delay" default:"1s" description:"First handler retry delay, doubled on each retry"`
+	RetryMaxDelay time.Duration `long:"retry_max_delay" default:"1m" description:"Handler retry delay limit"`
+	DeadTopic     string        `long:"dead_topic" default:"_dead" description:"Topic of dead letter notifications"`
+
+	Name string `long:"name" description:"Node name, used as publisher of messages without principal (hostname if empty)"`
+
+	Codec string `long:"codec" default:"json" description:"Default payload codec (json, msgpack)"`
+
+	Rules []string `long:"rule" default:"user:sub:user.{principal}" default:"user:sub:once.widget.*" default:"admin:*:>" description:"Access rule role:action:pattern (all allowed if empty)"`
+
+	// NoSchedule keeps scheduled messages in db without delivery, used by offline commands
+	NoSchedule bool `no-flag:"true"`
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
 
+// Slow subscriber policies
+const (
+	// OverflowDropOldest drops oldest buffered message
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropNewest drops message being delivered
+	OverflowDropNewest = "drop_newest"
+	// OverflowDisconnect closes subscriber channel
+	OverflowDisconnect = "disconnect"
+
+	// DefaultBufferSize used if Config.BufferSize is not set
+	DefaultBufferSize = 64
+)
+
 const (
 	// ErrNoSingleFile returned when does not contain single file in field 'file'
 	ErrNoSingleFile = "field 'file' does not contains single item"
@@ -31,18 +86,56 @@ var (
 	ErrNoAnyFile = errors.New("field 'file' does not contains any item")
 	// ErrNoAuth returned on Internal Server Error (no auth for upload)
 	ErrNoAuth = errors.New("This endpoint must be under AuthRequired")
+	// ErrClosed returned when hub is closed
+	ErrClosed = errors.New("pubsub is closed")
+	// ErrNotSubscribed returned when stream is unsubscribed or disconnected
+	ErrNotSubscribed = errors.New("stream is not subscribed")
 )
 
 type Message struct {
 	Topic   string
 	Payload []byte
+	// Offset holds position in durable topic log, 0 for other topics
+	Offset uint64
+	// Reply holds topic for request reply
+	Reply string
+	// Error holds error returned by responder
+	Error string
+	// Codec holds payload codec name, JSON if empty
+	Codec string
+	// ID holds unique message ID
+	ID string
+	// Time holds publish time
+	Time time.Time
+	// Publisher holds principal ID or node name
+	Publisher string
+	// Headers holds request ID, trace context etc
+	Headers map[string]string
 }
 type MessageStream chan Message
 
+// Stream holds messages of subscribed topics
 type Stream struct {
+	// Topic holds topic given to Subscribe
 	Topic      string
 	Messages   chan Message
 	unregister chan chan Message
+	change     chan *topicChange
+	authorize  func(context.Context, Action, string) error
+	// replay start offset, 0 - no replay
+	from  uint64
+	group string
+	ready chan struct{}
+	quit  <-chan struct{}
+}
+
+// topicChange holds request for stream topics change
+type topicChange struct {
+	c      chan Message
+	topics []string
+	add    bool
+	err    error
+	done   chan struct{}
 }
 
 // Service holds the set of active connections and broadcasts messages
@@ -50,126 +143,458 @@ type Service struct {
 	Config *Config
 	Log    *log.SugaredLogger
 	// Published messages
-	broadcast chan Message
+	local *Memory
+	// Messages shared between nodes, equal to local for memory transport
+	transport Transport
 	// Register requests from the connections.
 	register chan *Stream
 	// Unregister requests from connections.
 	unregister chan chan Message
+	// Stream topics change requests
+	change chan *topicChange
+	// Hub state requests
+	info chan chan *HubInfo
 	// Quit channel
 	quit chan struct{}
+	// closed when Run returns
+	done      chan struct{}
+	started   *atomic.Bool
+	closeOnce *sync.Once
+	// Durable topics log
+	db     *badger.DB
+	dbOnce *sync.Once
+	// Topic access checks, nil if all allowed
+	auth Authorizer
+	// Publish payload codec
+	codec Codec
+	// Wakes scheduler up on new scheduled message
+	wake chan struct{}
 }
 
 // New creates an Service object
-func New(cfg Config, logger *log.SugaredLogger) *Service {
+func New(cfg Config, logger *log.SugaredLogger) (*Service, error) {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowDropOldest
+	}
+	if cfg.Name == "" {
+		cfg.Name, _ = os.Hostname()
+	}
 	srv := Service{
 		Config:     &cfg,
 		Log:        logger,
-		broadcast:  make(chan Message),
+		local:      NewMemory(cfg.QueueSize),
 		register:   make(chan *Stream),
 		unregister: make(chan chan Message),
+		change:     make(chan *topicChange),
+		info:       make(chan chan *HubInfo),
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		started:    &atomic.Bool{},
+		closeOnce:  &sync.Once{},
+		dbOnce:     &sync.Once{},
+	}
+	srv.transport = srv.local
+	var err error
+	if srv.codec, err = CodecByName(cfg.Codec); err != nil {
+		return nil, err
+	}
+	if len(cfg.Rules) > 0 {
+		rules, err := ParseRules(cfg.Rules)
+		if err != nil {
+			return nil, err
+		}
+		srv.auth = rules
+	}
+	if cfg.Transport == "redis" {
+		if srv.transport, err = NewRedis(cfg.RedisAddr, cfg.RedisPrefix, logger); err != nil {
+			return nil, err
+		}
+	}
+	if srv.db, err = openLog(cfg); err != nil {
+		srv.transport.Close()
+		return nil, err
 	}
-	return &srv
+	if srv.db != nil && cfg.DataPath == "" {
+		logger.Warnw("Pubsub DB is in memory, durable topics, scheduled messages and dead letters will be lost on restart")
+	}
+	srv.publishExpvar()
+	return &srv, nil
 }
 
+// Close stops hub and waits for Run to return. It may be called many times
 func (srv Service) Close() {
-	if srv.quit != nil {
-		srv.quit <- struct{}{}
+	srv.closeOnce.Do(func() {
+		close(srv.quit)
+		srv.local.Close()
+		if err := srv.transport.Close(); err != nil {
+			srv.Log.Errorw("Transport close error", "error", err)
+		}
+	})
+	if srv.started.Load() {
+		<-srv.done
+		return
 	}
+	srv.closeLog()
 }
 
+// closeLog closes durable topics db once
+func (srv Service) closeLog() {
+	srv.dbOnce.Do(func() {
+		if srv.db == nil {
+			return
+		}
+		if err := srv.db.Close(); err != nil {
+			srv.Log.Errorw("Log close error", "error", err)
+		}
+	})
+}
+
+// Unmarshal decodes JSON payload, use Decode for messages of any codec
 func Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+// Unsubscribe removes stream from hub, Messages channel will be closed
 func (s Stream) Unsubscribe() {
-	s.unregister <- s.Messages
+	select {
+	case s.unregister <- s.Messages:
+	case <-s.quit:
+	}
+}
+
+// Add subscribes stream on topics or patterns
+func (s Stream) Add(ctx context.Context, topics ...string) error {
+	for _, topic := range topics {
+		if err := ValidPattern(topic); err != nil {
+			return err
+		}
+		if err := s.authorize(ctx, ActionSubscribe, topic); err != nil {
+			return err
+		}
+	}
+	return s.changeTopics(ctx, topics, true)
 }
 
-func (srv Service) Subscribe(topic string) (Stream, error) {
+// Remove unsubscribes stream from topics. Stream stays open without topics
+func (s Stream) Remove(ctx context.Context, topics ...string) error {
+	return s.changeTopics(ctx, topics, false)
+}
+
+func (s Stream) changeTopics(ctx context.Context, topics []string, add bool) error {
+	ch := &topicChange{c: s.Messages, topics: topics, add: add, done: make(chan struct{})}
+	select {
+	case s.change <- ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.quit:
+		return ErrClosed
+	}
+	<-ch.done
+	return ch.err
+}
+
+// Subscribe registers stream for topic or pattern (see Match).
+// Stream is unsubscribed when ctx is done
+func (srv Service) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (Stream, error) {
+	if err := ValidPattern(topic); err != nil {
+		return Stream{}, err
+	}
+	if err := srv.authorize(ctx, ActionSubscribe, topic); err != nil {
+		return Stream{}, err
+	}
+	return srv.subscribe(ctx, topic, opts...)
+}
+
+// subscribe registers stream without access check
+func (srv Service) subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (Stream, error) {
 	s := Stream{
 		Topic:      topic,
-		Messages:   make(chan Message),
 		unregister: srv.unregister,
+		change:     srv.change,
+		authorize:  srv.authorize,
+		ready:      make(chan struct{}),
+		quit:       srv.quit,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	select {
+	case srv.register <- &s:
+	case <-ctx.Done():
+		return Stream{}, ctx.Err()
+	case <-srv.quit:
+		return Stream{}, ErrClosed
+	}
+	<-s.ready
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			s.Unsubscribe()
+		}()
 	}
-	srv.register <- &s
 	return s, nil
 }
 
-func (srv Service) Publish(topic string, data interface{}) error {
-	b, err := json.Marshal(data)
+// Publish sends data encoded by default codec (Config.Codec) to topic subscribers
+func (srv Service) Publish(ctx context.Context, topic string, data interface{}) error {
+	return srv.PublishCodec(ctx, srv.codec, topic, data)
+}
+
+// PublishCodec sends data encoded by codec to topic subscribers
+func (srv Service) PublishCodec(ctx context.Context, codec Codec, topic string, data interface{}) error {
+	if err := srv.authorize(ctx, ActionPublish, topic); err != nil {
+		return err
+	}
+	b, err := codec.Marshal(data)
 	if err != nil {
 		return err
 	}
-	srv.Log.Debugw("Send event", "topic", topic, "data", string(b))
-	srv.broadcast <- Message{topic, b}
+	return srv.publish(ctx, Message{Topic: topic, Payload: b, Codec: codec.Name()})
+}
+
+// publish sends message to hub
+func (srv Service) publish(ctx context.Context, m Message) error {
+	if err := srv.envelope(ctx, &m); err != nil {
+		return err
+	}
+	srv.Log.Debugw("Send event", "topic", m.Topic, "id", m.ID, "request", m.Headers[HeaderRequestID],
+		"codec", m.Codec, "size", len(m.Payload))
+	var t Transport = srv.local
+	if srv.isShared(m.Topic) {
+		t = srv.transport
+	}
+	if err := t.Publish(ctx, m); err != nil {
+		return err
+	}
+	srv.count("published", m.Topic, 1)
 	return nil
 }
 
+// deliver sends message to subscriber without blocking.
+// It returns false if subscriber must be disconnected
+func (srv Service) deliver(c chan Message, m Message) bool {
+	select {
+	case c <- m:
+		srv.count("delivered", m.Topic, 1)
+		return true
+	default:
+	}
+	switch srv.Config.Overflow {
+	case OverflowDisconnect:
+		srv.Log.Warnw("Disconnect slow subscriber", "topic", m.Topic)
+		srv.count("disconnected", m.Topic, 1)
+		return false
+	case OverflowDropNewest:
+	default:
+		// subscriber may read buffer concurrently
+		select {
+		case old := <-c:
+			srv.count("dropped", old.Topic, 1)
+		default:
+		}
+		select {
+		case c <- m:
+			srv.count("delivered", m.Topic, 1)
+			return true
+		default:
+		}
+	}
+	srv.Log.Debugw("Drop message", "topic", m.Topic)
+	srv.count("dropped", m.Topic, 1)
+	return true
+}
+
+// matchSubscribers returns subscribers of topic and of patterns matching it
+func matchSubscribers(subscribers map[string]map[chan Message]bool, patterns map[string]bool, topic string) map[chan Message]bool {
+	rv := map[chan Message]bool{}
+	for k := range subscribers[topic] {
+		rv[k] = true
+	}
+	for p := range patterns {
+		if p == topic || !Match(p, topic) {
+			continue
+		}
+		for k := range subscribers[p] {
+			rv[k] = true
+		}
+	}
+	return rv
+}
+
 func (srv *Service) Run() {
 	subscribers := map[string]map[chan Message]bool{}
-	clients := map[chan Message]string{}
-	buffers := map[string][]Message{}
+	// topics of client
+	clients := map[chan Message]map[string]bool{}
+	buffers := newOnceBuffers(*srv.Config, srv.count)
+	var sweep <-chan time.Time
+	if srv.Config.Sweep > 0 {
+		ticker := time.NewTicker(srv.Config.Sweep)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+	// subscribed patterns with wildcards
+	patterns := map[string]bool{}
+	queues := newQueueGroups()
+	scheduleDone := make(chan struct{})
+	go srv.runSchedule(scheduleDone)
+	unsubscribe := func(c chan Message, topic string) {
+		srv.Log.Debugw("Unsubscribe", "topic", topic)
+		delete(clients[c], topic)
+		delete(subscribers[topic], c)
+		if len(subscribers[topic]) == 0 {
+			delete(subscribers, topic)
+			delete(patterns, topic)
+		}
+	}
+	remove := func(c chan Message) {
+		topics, ok := clients[c]
+		if !ok {
+			return
+		}
+		for topic := range topics {
+			unsubscribe(c, topic)
+		}
+		delete(clients, c)
+		queues.remove(c)
+		close(c)
+	}
+	subscribe := func(c chan Message, topic string) bool {
+		srv.Log.Debugw("Subscribe", "topic", topic)
+		if subscribers[topic] == nil {
+			subscribers[topic] = map[chan Message]bool{}
+		}
+		subscribers[topic][c] = true
+		clients[c][topic] = true
+		if IsPattern(topic) {
+			patterns[topic] = true
+		}
+		buffer := buffers.take(topic, time.Now())
+		if len(buffer) > 0 {
+			srv.Log.Debugw("Push waiting events", "count", len(buffer))
+		}
+		for _, m := range buffer {
+			srv.Log.Debugw("Hub buffer", "topic", m.Topic, "payload", string(m.Payload))
+			if !srv.deliver(c, m) {
+				remove(c)
+				return false
+			}
+		}
+		return true
+	}
+	// broadcast delivers published message
+	broadcast := func(m Message) {
+		// Loop over all clients in hub.
+		srv.Log.Debugw("Hub message", "topic", m.Topic, "payload", string(m.Payload))
+		durable := srv.isDurable(m.Topic)
+		if durable {
+			var err error
+			if m.Offset, err = srv.appendLog(m); err != nil {
+				srv.Log.Errorw("Log write error", "topic", m.Topic, "error", err)
+			}
+		}
+		topicSubscribers := matchSubscribers(subscribers, patterns, m.Topic)
+		queues.pick(topicSubscribers)
+		if len(topicSubscribers) == 0 {
+			if m.Reply != "" && !srv.isShared(m.Topic) {
+				// requester waits for reply
+				nr := Message{Topic: m.Reply, Error: ErrNoResponders.Error()}
+				for k := range matchSubscribers(subscribers, patterns, m.Reply) {
+					srv.deliver(k, nr)
+				}
+				return
+			}
+			if durable {
+				return
+			}
+			if !strings.HasPrefix(m.Topic, "once.") {
+				srv.Log.Warnw("No subscribers for topic", "topic", m.Topic)
+				return
+			}
+			// save in buffer
+			buffers.add(m, time.Now())
+		} else {
+			srv.Log.Debugw("Hub message point",
+				"topic", m.Topic,
+				"subscribers", len(topicSubscribers),
+				"payload", string(m.Payload))
+			for k := range topicSubscribers {
+				if !srv.deliver(k, m) {
+					remove(k)
+				}
+			}
+		}
+	}
+	var remote <-chan Message
+	if srv.transport != Transport(srv.local) {
+		remote = srv.transport.Messages()
+	}
+	srv.started.Store(true)
+	defer close(srv.done)
 	srv.Log.Debugw("Hub opened")
-	srv.quit = make(chan struct{})
 	for {
 		select {
 		case c := <-srv.register:
 			// Register new client in hub
-			topicSubscribers, ok := subscribers[c.Topic]
-			srv.Log.Debugw("Subscribe", "topic", c.Topic)
-			if !ok {
-				topicSubscribers = map[chan Message]bool{c.Messages: true}
-			} else {
-				topicSubscribers[c.Messages] = true
+			var backlog []Message
+			if c.from > 0 && srv.db != nil {
+				var err error
+				if backlog, err = srv.backlog(c.Topic, c.from); err != nil {
+					srv.Log.Errorw("Backlog read error", "topic", c.Topic, "error", err)
+				}
+			}
+			// backlog does not count in buffer size
+			c.Messages = make(chan Message, srv.Config.BufferSize+len(backlog))
+			for _, m := range backlog {
+				c.Messages <- m
+			}
+			close(c.ready)
+			clients[c.Messages] = map[string]bool{}
+			if c.group != "" {
+				queues.add(c.Messages, c.group)
 			}
-			subscribers[c.Topic] = topicSubscribers
-			clients[c.Messages] = c.Topic
-			if buffer, ok := buffers[c.Topic]; ok {
-				srv.Log.Debugw("Push waiting events", "count", len(buffer))
-				for _, m := range buffer {
-					srv.Log.Debugw("Hub buffer", "payload", string(m.Payload))
-					c.Messages <- m
+			subscribe(c.Messages, c.Topic)
+		case ch := <-srv.change:
+			// Add or remove client topics
+			if _, ok := clients[ch.c]; !ok {
+				ch.err = ErrNotSubscribed
+			}
+			for _, topic := range ch.topics {
+				if ch.err != nil {
+					break
+				}
+				if !ch.add {
+					unsubscribe(ch.c, topic)
+				} else if !subscribe(ch.c, topic) {
+					ch.err = ErrNotSubscribed
 				}
-				delete(buffers, c.Topic)
 			}
+			close(ch.done)
 		case c := <-srv.unregister:
 			// Unregister client from hub
-			if topic, ok := clients[c]; ok {
-				srv.Log.Debugw("Unsubscribe", "topic", topic)
-				delete(subscribers[topic], c)
-				delete(clients, c)
-				close(c)
-			}
-		case m := <-srv.broadcast:
-			// Loop over all clients in hub.
-			srv.Log.Debugw("Hub message", "topic", m.Topic, "payload", string(m.Payload))
-			topicSubscribers, ok := subscribers[m.Topic]
+			remove(c)
+		case m, ok := <-remote:
 			if !ok {
-				if !strings.HasPrefix(m.Topic, "once.") {
-					srv.Log.Warnw("No subscribers for topic", "topic", m.Topic)
-					continue
-				}
-				// save in buffer
-				buffer, ok := buffers[m.Topic]
-				if !ok {
-					buffer = []Message{m}
-				} else {
-					buffer = append(buffer, m)
-				}
-				buffers[m.Topic] = buffer
-			} else {
-				srv.Log.Debugw("Hub message point",
-					"topic", m.Topic,
-					"subscribers", len(topicSubscribers),
-					"payload", string(m.Payload))
-				for k := range topicSubscribers {
-					k <- m
-				}
+				srv.Log.Errorw("Transport closed")
+				remote = nil
+				continue
 			}
+			broadcast(m)
+		case m := <-srv.local.ch:
+			broadcast(m)
+		case reply := <-srv.info:
+			reply <- srv.hubInfo(subscribers, len(clients), buffers)
+		case now := <-sweep:
+			buffers.sweep(now)
 		case <-srv.quit:
 			for k := range clients {
 				close(k)
 			}
+			<-scheduleDone
+			srv.closeLog()
 			srv.Log.Debugw("Hub closed")
 			return
 		}
@@ -0,0 +1,841 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	log "go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func newTestService(t *testing.T, cfg Config) *Service {
+	srv, err := New(cfg, log.NewNop().Sugar())
+	require.NoError(t, err)
+	go srv.Run()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func receive(t *testing.T, s Stream) Message {
+	select {
+	case m := <-s.Messages:
+		return m
+	case <-time.After(time.Second):
+		require.Fail(t, "no message", s.Topic)
+	}
+	return Message{}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"user.a", "user.a", true},
+		{"user.a", "user.b", false},
+		{"user.*", "user.a", true},
+		{"user.*", "user", false},
+		{"user.*", "user.a.b", false},
+		{"*.a", "user.a", true},
+		{"once.widget.>", "once.widget.1", true},
+		{"once.widget.>", "once.widget.1.2", true},
+		{"once.widget.>", "once.widget", false},
+		{">", "file", true},
+		{"user.*", "user.", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Match(tt.pattern, tt.topic), tt.pattern+" "+tt.topic)
+	}
+	assert.NoError(t, ValidPattern("a.*.>"))
+	assert.ErrorIs(t, ValidPattern("a.>.b"), ErrBadPattern)
+	assert.ErrorIs(t, ValidPattern("a..b"), ErrBadPattern)
+}
+
+func TestWildcardSubscribe(t *testing.T) {
+	srv := newTestService(t, Config{})
+	_, err := srv.Subscribe(context.Background(), "user.>.x")
+	assert.ErrorIs(t, err, ErrBadPattern)
+
+	all, err := srv.Subscribe(context.Background(), "user.*")
+	require.NoError(t, err)
+	one, err := srv.Subscribe(context.Background(), "user.a")
+	require.NoError(t, err)
+	go srv.Publish(context.Background(), "user.a", 1)
+	// delivery order is not defined
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-all.Messages:
+			got[all.Topic] = m.Topic + "=" + string(m.Payload)
+		case m := <-one.Messages:
+			got[one.Topic] = m.Topic + "=" + string(m.Payload)
+		case <-time.After(time.Second):
+			require.Fail(t, "no message")
+		}
+	}
+	assert.Equal(t, map[string]string{"user.*": "user.a=1", "user.a": "user.a=1"}, got)
+	go srv.Publish(context.Background(), "user.b", 2)
+	m := receive(t, all)
+	assert.Equal(t, "user.b", m.Topic)
+	one.Unsubscribe()
+	all.Unsubscribe()
+
+	// once buffers are flushed to matching pattern
+	require.NoError(t, srv.Publish(context.Background(), "once.widget.1", 3))
+	require.NoError(t, srv.Publish(context.Background(), "once.other.1", 4))
+	w, err := srv.Subscribe(context.Background(), "once.widget.>")
+	require.NoError(t, err)
+	m = receive(t, w)
+	assert.Equal(t, "once.widget.1", m.Topic)
+	assert.Equal(t, "3", string(m.Payload))
+	w.Unsubscribe()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+		closed bool
+	}{
+		{OverflowDropOldest, []string{"2", "3"}, false},
+		{OverflowDropNewest, []string{"1", "2"}, false},
+		{OverflowDisconnect, []string{"1", "2"}, true},
+	}
+	for _, tt := range tests {
+		srv := newTestService(t, Config{BufferSize: 2, Overflow: tt.policy})
+		slow, err := srv.Subscribe(context.Background(), "user.a")
+		require.NoError(t, err)
+		fast, err := srv.Subscribe(context.Background(), "user.*")
+		require.NoError(t, err)
+		dropped := metrics.String()
+		for _, v := range []int{1, 2, 3} {
+			require.NoError(t, srv.Publish(context.Background(), "user.a", v))
+			// publish does not block
+			assert.Equal(t, "user.a", receive(t, fast).Topic)
+		}
+		var got []string
+		for m := range slow.Messages {
+			got = append(got, string(m.Payload))
+			if len(slow.Messages) == 0 && !tt.closed {
+				break
+			}
+		}
+		assert.Equal(t, tt.want, got, tt.policy)
+		if !tt.closed {
+			assert.NotEqual(t, dropped, metrics.String(), tt.policy)
+		}
+		fast.Unsubscribe()
+		slow.Unsubscribe()
+	}
+}
+
+func TestDurable(t *testing.T) {
+	cfg := Config{DataPath: t.TempDir(), Durable: []string{"user.*"}, RetainCount: 3}
+	srv, err := New(cfg, log.NewNop().Sugar())
+	require.NoError(t, err)
+	go srv.Run()
+	for _, v := range []int{1, 2, 3, 4} {
+		require.NoError(t, srv.Publish(context.Background(), "user.a", v))
+	}
+	require.NoError(t, srv.Publish(context.Background(), "user.b", 5))
+	require.NoError(t, srv.Publish(context.Background(), "file", 6))
+
+	payloads := func(s Stream) (rv []string) {
+		for len(s.Messages) > 0 {
+			m := <-s.Messages
+			rv = append(rv, m.Topic+"."+strconv.FormatUint(m.Offset, 10)+"="+string(m.Payload))
+		}
+		s.Unsubscribe()
+		return
+	}
+	// Subscribe is processed by hub after all publishes
+	s, err := srv.Subscribe(context.Background(), "user.a")
+	require.NoError(t, err)
+	assert.Empty(t, payloads(s))
+	s, err = srv.Subscribe(context.Background(), "user.a", FromEarliest())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.a.2=2", "user.a.3=3", "user.a.4=4"}, payloads(s))
+	s, err = srv.Subscribe(context.Background(), "user.a", FromOffset(4))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.a.4=4"}, payloads(s))
+	s, err = srv.Subscribe(context.Background(), "user.*", FromOffset(4))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.a.4=4"}, payloads(s))
+	s, err = srv.Subscribe(context.Background(), ">", FromEarliest())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.a.2=2", "user.a.3=3", "user.a.4=4", "user.b.1=5"}, payloads(s))
+
+	// offsets are kept after restart
+	srv.Close()
+	srv, err = New(cfg, log.NewNop().Sugar())
+	require.NoError(t, err)
+	go srv.Run()
+	defer srv.Close()
+	s, err = srv.Subscribe(context.Background(), "user.b", FromEarliest())
+	require.NoError(t, err)
+	require.NoError(t, srv.Publish(context.Background(), "user.b", 7))
+	assert.Equal(t, "user.b.1=5", payloads(s)[0])
+	s, err = srv.Subscribe(context.Background(), "user.b", FromOffset(2))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.b.2=7"}, payloads(s))
+}
+
+func TestOnceBuffers(t *testing.T) {
+	cfg := Config{OnceTTL: time.Minute, OnceMaxLen: 2, OnceMaxBytes: 4}
+	b := newOnceBuffers(cfg, Service{Config: &cfg}.count)
+	now := time.Now()
+	msg := func(topic, data string) Message { return Message{Topic: topic, Payload: []byte(data)} }
+	counter := func(name string) int64 {
+		if v := metrics.Get(name); v != nil {
+			return v.(*expvar.Int).Value()
+		}
+		return 0
+	}
+	expired, evicted := counter("once_expired"), counter("once_evicted")
+
+	b.add(msg("once.a", "1"), now)
+	b.add(msg("once.a", "2"), now)
+	b.add(msg("once.a", "3"), now) // over max len
+	assert.Equal(t, evicted+1, counter("once_evicted"))
+	b.add(msg("once.b", "44"), now.Add(time.Second))
+	b.add(msg("once.c", "5"), now.Add(time.Second)) // over max bytes
+	assert.Equal(t, evicted+2, counter("once_evicted"))
+	assert.Equal(t, 4, b.bytes)
+
+	b.sweep(now.Add(time.Minute + time.Millisecond))
+	assert.Equal(t, expired+1, counter("once_expired"))
+	assert.Equal(t, []Message{msg("once.b", "44")}, b.take("once.b", now))
+	assert.Empty(t, b.take("once.a", now))
+
+	// expired messages are not delivered
+	assert.Empty(t, b.take("once.>", now.Add(2*time.Minute)))
+	assert.Equal(t, expired+2, counter("once_expired"))
+	assert.Zero(t, b.bytes)
+	assert.Empty(t, b.topics)
+	b.sweep(now)
+	assert.Empty(t, b.order)
+
+	// order is compacted without sweep
+	for i := 0; i < 1000; i++ {
+		topic := "once.w." + strconv.Itoa(i)
+		b.add(msg("once.keep", "1"), now)
+		b.add(msg(topic, "1"), now)
+		assert.Len(t, b.take(topic, now), 1)
+		b.take("once.keep", now)
+	}
+	assert.LessOrEqual(t, len(b.order), 4)
+}
+
+func TestContext(t *testing.T) {
+	// Close does not block without Run
+	srv, err := New(Config{Durable: []string{"user.*"}}, log.NewNop().Sugar())
+	require.NoError(t, err)
+	srv.Close()
+	srv.Close()
+	assert.ErrorIs(t, srv.Publish(context.Background(), "user.a", 1), ErrClosed)
+	_, err = srv.Subscribe(context.Background(), "user.a")
+	assert.ErrorIs(t, err, ErrClosed)
+
+	srv = newTestService(t, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = srv.Subscribe(ctx, "user.a")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// stream is closed when context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	s, err := srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	cancel()
+	select {
+	case _, ok := <-s.Messages:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		require.Fail(t, "stream is not closed")
+	}
+}
+
+func TestTypedSubscribe(t *testing.T) {
+	type event struct {
+		ID string `json:"id"`
+	}
+	srv := newTestService(t, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := Subscribe[event](ctx, srv, "user.*")
+	require.NoError(t, err)
+	require.NoError(t, srv.Publish(ctx, "user.a", "bad"))
+	require.NoError(t, srv.Publish(WithHeader(ctx, HeaderRequestID, "r1"), "user.b", event{"1"}))
+	ev := <-events
+	assert.NotEmpty(t, ev.ID)
+	assert.Equal(t, Event[event]{Topic: "user.b", ID: ev.ID, Headers: map[string]string{HeaderRequestID: "r1"},
+		Value: event{"1"}}, ev)
+	cancel()
+	for range events {
+	}
+
+	// channel is closed on hub close
+	events, err = Subscribe[event](context.Background(), srv, "user.*")
+	require.NoError(t, err)
+	srv.Close()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestMultiTopic(t *testing.T) {
+	srv := newTestService(t, Config{})
+	ctx := context.Background()
+	require.NoError(t, srv.Publish(ctx, "once.widget.1", 1))
+	s, err := srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.Add(ctx, "a..b"), ErrBadPattern)
+	require.NoError(t, s.Add(ctx, "once.widget.1", "user.*"))
+	assert.Equal(t, "once.widget.1", receive(t, s).Topic)
+
+	// message is delivered once for all matching topics
+	require.NoError(t, srv.Publish(ctx, "user.a", 2))
+	require.NoError(t, srv.Publish(ctx, "user.b", 3))
+	assert.Equal(t, "2", string(receive(t, s).Payload))
+	assert.Equal(t, "3", string(receive(t, s).Payload))
+
+	require.NoError(t, s.Remove(ctx, "user.*"))
+	require.NoError(t, srv.Publish(ctx, "user.b", 4))
+	require.NoError(t, srv.Publish(ctx, "user.a", 5))
+	assert.Equal(t, "5", string(receive(t, s).Payload))
+
+	s.Unsubscribe()
+	assert.ErrorIs(t, s.Add(ctx, "user.b"), ErrNotSubscribed)
+}
+
+func TestAuthorize(t *testing.T) {
+	_, err := New(Config{Rules: []string{"user:get:user.a"}}, log.NewNop().Sugar())
+	assert.ErrorIs(t, err, ErrBadRule)
+
+	srv := newTestService(t, Config{Rules: []string{
+		"user:sub:user.{principal}",
+		"user:sub:once.widget.*",
+		"admin:*:>",
+	}})
+	user := WithPrincipal(context.Background(), Principal{ID: "a", Role: "user"})
+	admin := WithPrincipal(context.Background(), Principal{ID: "x", Role: "admin"})
+
+	s, err := srv.Subscribe(user, "user.a")
+	require.NoError(t, err)
+	defer s.Unsubscribe()
+	require.NoError(t, s.Add(user, "once.widget.1"))
+
+	var authErr AuthError
+	_, err = srv.Subscribe(user, "user.b")
+	require.ErrorAs(t, err, &authErr)
+	assert.Equal(t, ActionSubscribe, authErr.Action)
+	assert.Equal(t, "user.b", authErr.Topic)
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, s.Add(user, "user.*"), ErrForbidden)
+	assert.ErrorIs(t, s.Add(user, "once.widget.>"), ErrForbidden)
+	assert.ErrorIs(t, srv.Publish(user, "user.a", 1), ErrForbidden)
+	_, err = srv.Subscribe(WithPrincipal(context.Background(), Principal{ID: "*", Role: "user"}), "user.*")
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	// admin and calls without principal are allowed
+	sa, err := srv.Subscribe(admin, "user.*")
+	require.NoError(t, err)
+	defer sa.Unsubscribe()
+	require.NoError(t, srv.Publish(admin, "user.a", 2))
+	assert.Equal(t, "2", string(receive(t, s).Payload))
+	assert.Equal(t, "2", string(receive(t, sa).Payload))
+	require.NoError(t, srv.Publish(context.Background(), "once.widget.1", 3))
+	assert.Equal(t, "3", string(receive(t, s).Payload))
+
+	assert.True(t, Covers("user.*", "user.a"))
+	assert.False(t, Covers("user.*", "user.>"))
+	assert.True(t, Covers("user.>", "user.*.b"))
+	assert.False(t, Covers("user.a", "user.*"))
+}
+
+func TestCodec(t *testing.T) {
+	_, err := New(Config{Codec: "xml"}, log.NewNop().Sugar())
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+
+	type item struct {
+		Name string `json:"name"`
+		N    int    `json:"n"`
+	}
+	srv := newTestService(t, Config{Codec: CodecMsgPack, Durable: []string{"user.*"}})
+	ctx := context.Background()
+	events, err := Subscribe[item](ctx, srv, "user.a")
+	require.NoError(t, err)
+	require.NoError(t, srv.Publish(ctx, "user.a", item{"a", 1}))
+	assert.Equal(t, item{"a", 1}, (<-events).Value)
+	require.NoError(t, srv.PublishCodec(ctx, Protobuf{}, "user.a", wrapperspb.String("b")))
+	assert.ErrorIs(t, srv.PublishCodec(ctx, Protobuf{}, "user.a", item{}), ErrNotProto)
+
+	// codec is kept in durable log
+	s, err := srv.Subscribe(ctx, "user.a", FromEarliest())
+	require.NoError(t, err)
+	defer s.Unsubscribe()
+	m := receive(t, s)
+	assert.Equal(t, CodecMsgPack, m.Codec)
+	data, err := Transcode(m, JSON{})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"a","n":1}`, string(data))
+
+	m = receive(t, s)
+	assert.Equal(t, CodecProtobuf, m.Codec)
+	var pv *wrapperspb.StringValue
+	require.NoError(t, Decode(m, &pv))
+	assert.Equal(t, "b", pv.GetValue())
+	_, err = Transcode(m, JSON{})
+	assert.ErrorIs(t, err, ErrNotProto)
+
+	m.Codec = "xml"
+	assert.ErrorIs(t, Decode(m, &pv), ErrUnknownCodec)
+	assert.Contains(t, CodecNames(), CodecMsgPack)
+}
+
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	_, err := newTestService(t, Config{}).PublishAfter(ctx, 0, "user.a", 0)
+	assert.ErrorIs(t, err, ErrNoStore)
+
+	cfg := Config{DataPath: t.TempDir()}
+	srv, err := New(cfg, log.NewNop().Sugar())
+	require.NoError(t, err)
+	go srv.Run()
+	s, err := srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	id1, err := srv.PublishAfter(ctx, 50*time.Millisecond, "user.a", 1)
+	require.NoError(t, err)
+	id2, err := srv.PublishAfter(ctx, time.Hour, "user.a", 2)
+	require.NoError(t, err)
+	id3, err := srv.PublishAfter(ctx, time.Hour, "user.a", 3)
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(receive(t, s).Payload))
+	assert.ErrorIs(t, srv.Cancel(ctx, id1), ErrNotScheduled)
+	require.NoError(t, srv.Cancel(ctx, id2))
+	srv.Close()
+
+	// scheduled messages are kept after restart
+	srv = newTestService(t, cfg)
+	assert.ErrorIs(t, srv.Cancel(ctx, id2), ErrNotScheduled)
+	require.NoError(t, srv.Cancel(ctx, id3))
+	s, err = srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	defer s.Unsubscribe()
+	_, err = srv.PublishAt(ctx, time.Now().Add(-time.Minute), "user.a", 4)
+	require.NoError(t, err)
+	assert.Equal(t, "4", string(receive(t, s).Payload))
+}
+
+func TestNoSchedule(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestService(t, Config{DataPath: t.TempDir(), NoSchedule: true})
+	s, err := srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	defer s.Unsubscribe()
+	id, err := srv.PublishAt(ctx, time.Now().Add(-time.Minute), "user.a", 1)
+	require.NoError(t, err)
+	select {
+	case <-s.Messages:
+		t.Fatal("scheduled message is sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, srv.Cancel(ctx, id))
+}
+
+func TestScheduleCancelRace(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestService(t, Config{DataPath: t.TempDir()})
+	s, err := srv.Subscribe(ctx, "user.a")
+	require.NoError(t, err)
+	defer s.Unsubscribe()
+	const n = 50
+	sent := map[string]bool{}
+	for i := 0; i < n; i++ {
+		at := time.Now().Add(time.Duration(i%5) * time.Millisecond)
+		id, err := srv.PublishAt(ctx, at, "user.a", i)
+		require.NoError(t, err)
+		// due message is sent by scheduler and sendDue concurrently with Cancel
+		done := make(chan error, 1)
+		go func() {
+			_, err := srv.sendDue(ctx, at)
+			done <- err
+		}()
+		err = srv.Cancel(ctx, id)
+		if err != nil {
+			require.ErrorIs(t, err, ErrNotScheduled)
+			sent[id] = true
+		}
+		require.NoError(t, <-done)
+	}
+	time.Sleep(50 * time.Millisecond)
+	received := map[string]bool{}
+	for len(s.Messages) > 0 {
+		m := <-s.Messages
+		assert.False(t, received[m.ID], "message sent twice")
+		received[m.ID] = true
+	}
+	assert.Equal(t, sent, received)
+}
+
+func TestHandle(t *testing.T) {
+	srv := newTestService(t, Config{Durable: []string{"user.*"}, Retries: 2, RetryDelay: time.Millisecond,
+		DeadTopic: "_dead", Name: "node"})
+	ctx, cancel := context.WithCancel(context.Background())
+	dead, err := Subscribe[DeadLetter](ctx, srv, "_dead")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	calls := map[int]int{}
+	lasts := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- Handle(ctx, srv, "job", func(ctx context.Context, ev Event[int]) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[ev.Value]++
+			if LastAttempt(ctx) {
+				lasts++
+			}
+			if ev.Value == 1 && calls[1] == 1 {
+				return errors.New("temporary")
+			}
+			if ev.Value == 2 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		info, err := srv.Info(ctx)
+		require.NoError(t, err)
+		for _, ti := range info.Topics {
+			if ti.Topic == "job" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, srv.Publish(ctx, "job", 1))
+	require.NoError(t, srv.Publish(ctx, "job", 2))
+	dl := (<-dead).Value
+	assert.NotEmpty(t, dl.MessageID)
+	assert.Equal(t, DeadLetter{ID: dl.ID, Topic: "job", Payload: []byte("2"), Codec: CodecJSON,
+		Error: "failed", Attempts: 3, Time: dl.Time, MessageID: dl.MessageID, Publisher: "node"}, dl)
+	// decode error is not retried
+	require.NoError(t, srv.Publish(ctx, "job", "x"))
+	assert.Equal(t, 1, (<-dead).Value.Attempts)
+
+	list, err := srv.DeadLetters(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, dl.ID, list[0].ID)
+	require.NoError(t, srv.DeleteDeadLetter(ctx, list[1].ID))
+	require.NoError(t, srv.Replay(ctx, dl.ID))
+	assert.Equal(t, 3, (<-dead).Value.Attempts)
+	assert.ErrorIs(t, srv.Replay(ctx, dl.ID), ErrNoDeadLetter)
+
+	mu.Lock()
+	assert.Equal(t, 2, calls[1])
+	assert.Equal(t, 6, calls[2])
+	assert.Equal(t, 2, lasts)
+	mu.Unlock()
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestEnvelope(t *testing.T) {
+	srv := newTestService(t, Config{Durable: []string{"user.*"}, Name: "node"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := srv.Subscribe(ctx, "user.*")
+	require.NoError(t, err)
+	go Handle(ctx, srv, "job", func(ctx context.Context, ev Event[int]) error {
+		return srv.Publish(WithHeader(ctx, "X-Job", "1"), "user.b", ev.Value)
+	})
+	require.Eventually(t, func() bool {
+		info, err := srv.Info(ctx)
+		require.NoError(t, err)
+		return len(info.Topics) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// headers are propagated by handler
+	rctx := WithHeader(ctx, HeaderRequestID, "r1")
+	require.NoError(t, srv.Publish(rctx, "job", 1))
+	m := receive(t, s)
+	assert.Equal(t, "node", m.Publisher)
+	assert.Equal(t, map[string]string{HeaderRequestID: "r1", "X-Job": "1"}, m.Headers)
+
+	// envelope is kept in durable log
+	require.NoError(t, srv.Publish(WithPrincipal(rctx, Principal{ID: "a"}), "user.a", 2))
+	live := receive(t, s)
+	assert.Equal(t, "a", live.Publisher)
+	r, err := srv.Subscribe(ctx, "user.a", FromEarliest())
+	require.NoError(t, err)
+	m = receive(t, r)
+	assert.Equal(t, live.ID, m.ID)
+	assert.True(t, live.Time.Equal(m.Time))
+	assert.Equal(t, live.Headers, m.Headers)
+	assert.Equal(t, "a", m.Publisher)
+}
+
+func TestRequest(t *testing.T) {
+	srv := newTestService(t, Config{RequestTimeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := srv.Request(ctx, "sum", []int{1, 2})
+	assert.ErrorIs(t, err, ErrNoResponders)
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- Serve(ctx, srv, "sum", func(_ context.Context, req []int) (int, error) {
+			if len(req) == 0 {
+				return 0, errors.New("empty")
+			}
+			return req[0] + req[1], nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		_, err := srv.Request(ctx, "sum", []int{1, 2})
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	m, err := srv.Request(ctx, "sum", []int{2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, "5", string(m.Payload))
+	_, err = srv.Request(ctx, "sum", []int{})
+	assert.ErrorIs(t, err, ErrReply)
+	assert.ErrorContains(t, err, "empty")
+
+	assert.ErrorIs(t, srv.Respond(ctx, Message{}, 1), ErrNoReply)
+	cancel()
+	assert.ErrorIs(t, <-ready, context.Canceled)
+
+	// responder does not reply in time
+	s, err := srv.Subscribe(context.Background(), "slow")
+	require.NoError(t, err)
+	_, err = srv.Request(context.Background(), "slow", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotEmpty(t, receive(t, s).Reply)
+}
+
+func TestQueueGroup(t *testing.T) {
+	srv := newTestService(t, Config{})
+	ctx := context.Background()
+	// hub handles Subscribe after previous messages delivery
+	wait := func() {
+		s, err := srv.Subscribe(ctx, "wait")
+		require.NoError(t, err)
+		s.Unsubscribe()
+	}
+	var workers []Stream
+	for i := 0; i < 3; i++ {
+		s, err := srv.Subscribe(ctx, "widget", Queue("widget"))
+		require.NoError(t, err)
+		workers = append(workers, s)
+	}
+	all, err := srv.Subscribe(ctx, "widget")
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, srv.Publish(ctx, "widget", i))
+	}
+	wait()
+	assert.Len(t, all.Messages, 6)
+	// round robin
+	for _, s := range workers {
+		assert.Len(t, s.Messages, 2)
+	}
+	workers[0].Unsubscribe()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, srv.Publish(ctx, "widget", i))
+	}
+	wait()
+	assert.Len(t, workers[1].Messages, 3)
+	assert.Len(t, workers[2].Messages, 3)
+}
+
+// fakeRedis serves PSUBSCRIBE (prefix* patterns only) and PUBLISH
+func fakeRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	subs := map[net.Conn]string{}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			v, err := readReply(r)
+			args, ok := v.([]interface{})
+			if err != nil || !ok || len(args) < 2 {
+				mu.Lock()
+				delete(subs, conn)
+				mu.Unlock()
+				return
+			}
+			mu.Lock()
+			switch args[0] {
+			case "PSUBSCRIBE":
+				subs[conn] = args[1].(string)
+				writeCommand(conn, "psubscribe", args[1].(string), "1")
+			case "PUBLISH":
+				channel := args[1].(string)
+				n := 0
+				for c, pattern := range subs {
+					if strings.HasPrefix(channel, strings.TrimSuffix(pattern, "*")) {
+						writeCommand(c, "pmessage", pattern, channel, args[2].(string))
+						n++
+					}
+				}
+				conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+			default:
+				conn.Write([]byte("-ERR unknown command\r\n"))
+			}
+			mu.Unlock()
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRedisTransport(t *testing.T) {
+	cfg := Config{Transport: "redis", RedisAddr: fakeRedis(t), RedisPrefix: "sfs.", Shared: []string{"user.*", "once.>"}}
+	a, b := newTestService(t, cfg), newTestService(t, cfg)
+	ctx := context.Background()
+	sa, err := a.Subscribe(ctx, "file")
+	require.NoError(t, err)
+	sb, err := b.Subscribe(ctx, "user.x")
+	require.NoError(t, err)
+	require.NoError(t, sb.Add(ctx, "file"))
+
+	require.NoError(t, a.Publish(ctx, "file", 1))
+	require.NoError(t, a.Publish(WithHeader(ctx, HeaderTraceParent, "00-1-2-01"), "user.x", 2))
+	m := receive(t, sb)
+	// envelope is sent via transport
+	assert.NotEmpty(t, m.ID)
+	assert.False(t, m.Time.IsZero())
+	assert.Equal(t, Message{Topic: "user.x", Payload: []byte("2"), Codec: CodecJSON, ID: m.ID, Time: m.Time,
+		Publisher: a.Config.Name, Headers: map[string]string{HeaderTraceParent: "00-1-2-01"}}, m)
+	// not shared topic is delivered locally
+	assert.Equal(t, "1", string(receive(t, sa).Payload))
+	assert.Empty(t, sb.Messages)
+
+	// once topics are buffered on every node
+	require.NoError(t, a.Publish(ctx, "once.widget.1", 3))
+	require.Eventually(t, func() bool {
+		s, err := b.Subscribe(ctx, "once.widget.1")
+		require.NoError(t, err)
+		defer s.Unsubscribe()
+		select {
+		case m := <-s.Messages:
+			return string(m.Payload) == "3"
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 20*time.Millisecond)
+
+	_, err = readReply(bufio.NewReader(strings.NewReader("-ERR bad\r\n")))
+	assert.ErrorIs(t, err, ErrRedis)
+}
+
+func TestRedisReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	// first PUBLISH drops connection, second one is not replied, others are replied
+	var publishes atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					v, err := readReply(r)
+					args, ok := v.([]interface{})
+					if err != nil || !ok || len(args) < 2 {
+						return
+					}
+					if args[0] == "PSUBSCRIBE" {
+						writeCommand(conn, "psubscribe", args[1].(string), "1")
+						continue
+					}
+					switch publishes.Add(1) {
+					case 1:
+						return
+					case 2:
+					default:
+						conn.Write([]byte(":0\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	tr, err := NewRedis(ln.Addr().String(), "sfs.", log.NewNop().Sugar())
+	require.NoError(t, err)
+	defer tr.Close()
+	tr.Timeout = 100 * time.Millisecond
+	ctx := context.Background()
+	m := Message{Topic: "file", Payload: []byte("1")}
+	assert.Error(t, tr.Publish(ctx, m), "dropped connection")
+	start := time.Now()
+	assert.Error(t, tr.Publish(ctx, m), "no reply")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.NoError(t, tr.Publish(ctx, m))
+	assert.Equal(t, int32(3), publishes.Load())
+}
+
+func TestInfo(t *testing.T) {
+	srv := newTestService(t, Config{MetricPrefixes: []string{"user.", "once.widget.", "file"}})
+	ctx := context.Background()
+	counter := func(prefix, name string) int64 {
+		if m, ok := topicMetrics.Get(prefix).(*expvar.Map); ok {
+			if v, ok := m.Get(name).(*expvar.Int); ok {
+				return v.Value()
+			}
+		}
+		return 0
+	}
+	delivered, buffered, other := counter("user.", "delivered"), counter("once.widget.", "buffered"), counter(OtherPrefix, "published")
+	for _, topic := range []string{"user.a", "user.*", "file"} {
+		_, err := srv.Subscribe(ctx, topic)
+		require.NoError(t, err)
+	}
+	require.NoError(t, srv.Publish(ctx, "user.a", 1))
+	require.NoError(t, srv.Publish(ctx, "once.widget.1", "22"))
+	require.NoError(t, srv.Publish(ctx, "files", 3))
+
+	info, err := srv.Info(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []TopicInfo{{"file", 1, 0}, {"user.*", 1, 1}, {"user.a", 1, 1}}, info.Topics)
+	assert.Equal(t, []BufferInfo{{"once.widget.1", 1, 4}}, info.Buffers)
+	assert.Equal(t, 3, info.Clients)
+	assert.Equal(t, map[string]PrefixInfo{
+		"file":         {Subscribers: 1},
+		"user.":        {Subscribers: 2, Depth: 2},
+		"once.widget.": {Buffered: 1},
+	}, info.Gauges)
+	assert.Equal(t, delivered+2, counter("user.", "delivered"))
+	assert.Equal(t, buffered+1, counter("once.widget.", "buffered"))
+	assert.Equal(t, other+1, counter(OtherPrefix, "published"))
+}
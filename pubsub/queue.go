@@ -0,0 +1,74 @@
+package pubsub
+
+// Queue sets stream queue group. Each message is delivered to one stream of group
+func Queue(group string) SubscribeOption {
+	return func(s *Stream) { s.group = group }
+}
+
+// queueGroups holds group members in subscription order
+type queueGroups struct {
+	members map[string][]chan Message
+	next    map[string]int
+	groups  map[chan Message]string
+}
+
+func newQueueGroups() *queueGroups {
+	return &queueGroups{
+		members: map[string][]chan Message{},
+		next:    map[string]int{},
+		groups:  map[chan Message]string{},
+	}
+}
+
+func (q *queueGroups) add(c chan Message, group string) {
+	q.groups[c] = group
+	q.members[group] = append(q.members[group], c)
+}
+
+func (q *queueGroups) remove(c chan Message) {
+	group, ok := q.groups[c]
+	if !ok {
+		return
+	}
+	delete(q.groups, c)
+	members := q.members[group]
+	for i, m := range members {
+		if m == c {
+			members = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(q.members, group)
+		delete(q.next, group)
+		return
+	}
+	q.members[group] = members
+}
+
+// pick removes from matched all group members except the next one (round robin)
+func (q *queueGroups) pick(matched map[chan Message]bool) {
+	picked := map[string]bool{}
+	for c := range matched {
+		group, ok := q.groups[c]
+		if !ok || picked[group] {
+			continue
+		}
+		picked[group] = true
+		members := q.members[group]
+		var chosen chan Message
+		for i := range members {
+			idx := (q.next[group] + i) % len(members)
+			if matched[members[idx]] {
+				chosen = members[idx]
+				q.next[group] = idx + 1
+				break
+			}
+		}
+		for _, m := range members {
+			if m != chosen {
+				delete(matched, m)
+			}
+		}
+	}
+}
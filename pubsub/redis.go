@@ -0,0 +1,277 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "go.uber.org/zap"
+)
+
+const (
+	// redisReconnect is the delay before reconnect after subscription error
+	redisReconnect = time.Second
+	// redisTimeout is the default deadline of PUBLISH command
+	redisTimeout = 5 * time.Second
+)
+
+// ErrRedis returned when redis replies with error
+var ErrRedis = errors.New("redis error")
+
+// Redis transport publishes messages to redis channels named as prefix + topic
+type Redis struct {
+	Addr   string
+	Prefix string
+	Log    *log.SugaredLogger
+	// Timeout is used as PUBLISH deadline when ctx has no deadline
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	pub      net.Conn
+	pubR     *bufio.Reader
+	sub      net.Conn
+	messages chan Message
+	done     chan struct{}
+}
+
+// NewRedis connects to redis server and subscribes on prefix channels
+func NewRedis(addr, prefix string, logger *log.SugaredLogger) (*Redis, error) {
+	t := &Redis{
+		Addr:     addr,
+		Prefix:   prefix,
+		Log:      logger,
+		Timeout:  redisTimeout,
+		messages: make(chan Message),
+		done:     make(chan struct{}),
+	}
+	if err := t.dialPub(); err != nil {
+		return nil, err
+	}
+	sub, r, err := t.subscribe()
+	if err != nil {
+		t.pub.Close()
+		return nil, err
+	}
+	t.sub = sub
+	go t.readLoop(sub, r)
+	return t, nil
+}
+
+// dialPub opens connection for PUBLISH, called under mu
+func (t *Redis) dialPub() error {
+	conn, err := net.DialTimeout("tcp", t.Addr, t.Timeout)
+	if err != nil {
+		return err
+	}
+	t.pub, t.pubR = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// subscribe opens connection for PSUBSCRIBE
+func (t *Redis) subscribe() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("tcp", t.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if err = writeCommand(conn, "PSUBSCRIBE", t.Prefix+"*"); err == nil {
+		_, err = readReply(r)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, r, nil
+}
+
+// readLoop reads pmessage replies and resubscribes on errors until Close
+func (t *Redis) readLoop(conn net.Conn, r *bufio.Reader) {
+	defer close(t.messages)
+	for {
+		m, err := t.readMessage(r)
+		if err == nil {
+			select {
+			case t.messages <- m:
+			case <-t.done:
+				return
+			}
+			continue
+		}
+		conn.Close()
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		t.Log.Warnw("Redis subscription error", "error", err)
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-time.After(redisReconnect):
+			}
+			if conn, r, err = t.subscribe(); err == nil {
+				t.mu.Lock()
+				t.sub = conn
+				t.mu.Unlock()
+				select {
+				case <-t.done:
+					// closed while subscribing
+					conn.Close()
+					return
+				default:
+				}
+				break
+			}
+			t.Log.Warnw("Redis reconnect error", "error", err)
+		}
+	}
+}
+
+// readMessage reads pmessage reply
+func (t *Redis) readMessage(r *bufio.Reader) (Message, error) {
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return Message{}, err
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) != 4 || a[0] != "pmessage" {
+			// subscribe confirmations etc
+			continue
+		}
+		channel, _ := a[2].(string)
+		data, _ := a[3].(string)
+		var rm storedMessage
+		if err = json.Unmarshal([]byte(data), &rm); err != nil || len(channel) < len(t.Prefix) {
+			t.Log.Warnw("Redis message decode error", "channel", channel, "error", err)
+			continue
+		}
+		return rm.message(channel[len(t.Prefix):]), nil
+	}
+}
+
+// Publish sends PUBLISH command.
+// Connection is closed on error and dialed again by next Publish
+func (t *Redis) Publish(ctx context.Context, m Message) error {
+	data, err := json.Marshal(newStoredMessage(m, false))
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return ErrClosed
+	default:
+	}
+	if t.pub == nil {
+		if err = t.dialPub(); err != nil {
+			return err
+		}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(t.Timeout)
+	}
+	t.pub.SetDeadline(deadline)
+	conn := t.pub
+	// unblock conn io when ctx is canceled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if err = writeCommand(t.pub, "PUBLISH", t.Prefix+m.Topic, string(data)); err == nil {
+		_, err = readReply(t.pubR)
+	}
+	if err != nil {
+		// reply may be out of sync
+		t.pub.Close()
+		t.pub, t.pubR = nil, nil
+	}
+	return err
+}
+
+// Messages returns channel of received messages
+func (t *Redis) Messages() <-chan Message {
+	return t.messages
+}
+
+// Close closes connections
+func (t *Redis) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+	close(t.done)
+	t.sub.Close()
+	if t.pub == nil {
+		return nil
+	}
+	return t.pub.Close()
+}
+
+// writeCommand writes command as RESP array of bulk strings
+func writeCommand(w io.Writer, args ...string) error {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(a)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, a...)
+		b = append(b, "\r\n"...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readReply reads RESP value. Strings are returned as string, integers as int64, arrays as []interface{}
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: bad reply line %q", ErrRedis, line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, fmt.Errorf("%w: %s", ErrRedis, body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		rv := make([]interface{}, size)
+		for i := range rv {
+			if rv[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return rv, nil
+	}
+	return nil, fmt.Errorf("%w: unknown reply type %q", ErrRedis, kind)
+}
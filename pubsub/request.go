@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// InboxPrefix is the prefix of request reply topics
+const InboxPrefix = "_inbox."
+
+var (
+	// ErrNoResponders returned by Request when topic has no subscribers
+	ErrNoResponders = errors.New("no responders")
+	// ErrNoReply returned by Respond when message is not a request
+	ErrNoReply = errors.New("message has no reply topic")
+	// ErrReply wraps error returned by responder
+	ErrReply = errors.New("request failed")
+)
+
+// newID returns random hex ID
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newInbox returns unique reply topic
+func newInbox() (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	return InboxPrefix + id, nil
+}
+
+// Request publishes data to topic and waits for the first reply.
+// Wait is limited by Config.RequestTimeout if it is set
+func (srv Service) Request(ctx context.Context, topic string, data interface{}) (Message, error) {
+	if err := srv.authorize(ctx, ActionPublish, topic); err != nil {
+		return Message{}, err
+	}
+	if srv.Config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.Config.RequestTimeout)
+		defer cancel()
+	}
+	b, err := srv.codec.Marshal(data)
+	if err != nil {
+		return Message{}, err
+	}
+	inbox, err := newInbox()
+	if err != nil {
+		return Message{}, err
+	}
+	s, err := srv.subscribe(ctx, inbox)
+	if err != nil {
+		return Message{}, err
+	}
+	defer s.Unsubscribe()
+	if err = srv.publish(ctx, Message{Topic: topic, Payload: b, Reply: inbox, Codec: srv.codec.Name()}); err != nil {
+		return Message{}, err
+	}
+	select {
+	case m, ok := <-s.Messages:
+		switch {
+		case !ok:
+			return Message{}, ErrClosed
+		case m.Error == ErrNoResponders.Error():
+			return m, ErrNoResponders
+		case m.Error != "":
+			return m, fmt.Errorf("%w: %s", ErrReply, m.Error)
+		}
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Respond sends data as reply to request
+func (srv Service) Respond(ctx context.Context, req Message, data interface{}) error {
+	if req.Reply == "" {
+		return ErrNoReply
+	}
+	codec, err := CodecByName(req.Codec)
+	if err != nil {
+		return err
+	}
+	b, err := codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return srv.publish(ctx, Message{Topic: req.Reply, Payload: b, Codec: codec.Name()})
+}
+
+// RespondError sends error as reply to request
+func (srv Service) RespondError(ctx context.Context, req Message, e error) error {
+	if req.Reply == "" {
+		return ErrNoReply
+	}
+	return srv.publish(ctx, Message{Topic: req.Reply, Error: e.Error()})
+}
+
+// Serve handles requests of topic until ctx is done or hub is closed.
+// Requests are decoded into Req, handler result is sent as reply
+func Serve[Req, Resp any](ctx context.Context, srv *Service, topic string,
+	handler func(context.Context, Req) (Resp, error), opts ...SubscribeOption) error {
+	s, err := srv.Subscribe(ctx, topic, opts...)
+	if err != nil {
+		return err
+	}
+	defer s.Unsubscribe()
+	for m := range s.Messages {
+		var req Req
+		var resp Resp
+		hctx := WithHeaders(ctx, m.Headers)
+		err := Decode(m, &req)
+		if err == nil {
+			resp, err = handler(hctx, req)
+		}
+		if m.Reply == "" {
+			if err != nil {
+				srv.Log.Errorw("Request handler error", "topic", m.Topic, "id", m.ID, "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			err = srv.RespondError(hctx, m, err)
+		} else {
+			err = srv.Respond(hctx, m, resp)
+		}
+		if err != nil {
+			srv.Log.Errorw("Reply error", "topic", m.Topic, "id", m.ID, "error", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrClosed
+}
@@ -0,0 +1,245 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Scheduled message keys
+const (
+	// atPrefix + delivery time (unix nano, uint64 BE) + id holds scheduled message
+	atPrefix = "ps.at."
+	// idPrefix + id holds atPrefix key of scheduled message
+	idPrefix = "ps.id."
+
+	// scheduleBatch is the max number of messages sent at once
+	scheduleBatch = 100
+	// scheduleIdle is the wait period when there are no scheduled messages
+	scheduleIdle = time.Hour
+	// scheduleRetry is the delay after db error
+	scheduleRetry = time.Second
+)
+
+var (
+	// ErrNoStore returned when db is not opened (no data path and durable topics)
+	ErrNoStore = errors.New("pubsub db is not opened")
+	// ErrNotScheduled returned by Cancel when message is not found or already sent
+	ErrNotScheduled = errors.New("message is not scheduled")
+)
+
+// PublishAt schedules delivery of data to topic at given time.
+// It returns message ID for Cancel, it is also used as Message.ID. Scheduled messages are kept in db and survive restart
+func (srv Service) PublishAt(ctx context.Context, at time.Time, topic string, data interface{}) (string, error) {
+	if srv.db == nil {
+		return "", ErrNoStore
+	}
+	if err := srv.authorize(ctx, ActionPublish, topic); err != nil {
+		return "", err
+	}
+	b, err := srv.codec.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	m := Message{Topic: topic, Payload: b, Codec: srv.codec.Name()}
+	if err = srv.envelope(ctx, &m); err != nil {
+		return "", err
+	}
+	// time is set on delivery
+	m.Time = time.Time{}
+	value, err := json.Marshal(newStoredMessage(m, true))
+	if err != nil {
+		return "", err
+	}
+	id := m.ID
+	key := atKey(at, id)
+	err = srv.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(key, value); err != nil {
+			return err
+		}
+		return txn.Set([]byte(idPrefix+id), key)
+	})
+	if err != nil {
+		return "", err
+	}
+	srv.Log.Debugw("Schedule event", "topic", topic, "id", id, "at", at)
+	select {
+	case srv.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// PublishAfter schedules delivery of data to topic after delay
+func (srv Service) PublishAfter(ctx context.Context, delay time.Duration, topic string, data interface{}) (string, error) {
+	return srv.PublishAt(ctx, time.Now().Add(delay), topic, data)
+}
+
+// Cancel removes scheduled message
+func (srv Service) Cancel(ctx context.Context, id string) error {
+	if srv.db == nil {
+		return ErrNoStore
+	}
+	err := srv.db.Update(func(txn *badger.Txn) error {
+		idKey := []byte(idPrefix + id)
+		item, err := txn.Get(idKey)
+		if err == badger.ErrKeyNotFound {
+			return ErrNotScheduled
+		} else if err != nil {
+			return err
+		}
+		key, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err = txn.Delete(key); err != nil {
+			return err
+		}
+		return txn.Delete(idKey)
+	})
+	if err == badger.ErrConflict {
+		// claimed by sendDue
+		return ErrNotScheduled
+	}
+	return err
+}
+
+// atKey returns db key of scheduled message
+func atKey(at time.Time, id string) []byte {
+	key := make([]byte, 0, len(atPrefix)+8+len(id))
+	key = append(key, atPrefix...)
+	key = binary.BigEndian.AppendUint64(key, uint64(at.UnixNano()))
+	return append(key, id...)
+}
+
+// runSchedule publishes scheduled messages until hub is closed
+func (srv Service) runSchedule(done chan struct{}) {
+	defer close(done)
+	if srv.db == nil || srv.Config.NoSchedule {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-srv.quit
+		cancel()
+	}()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-srv.quit:
+			return
+		case <-srv.wake:
+		case <-timer.C:
+		}
+		wait, err := srv.sendDue(ctx, time.Now())
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			srv.Log.Errorw("Scheduled message error", "error", err)
+			wait = scheduleRetry
+		}
+		timer.Reset(wait)
+	}
+}
+
+// claim removes scheduled message before it is sent.
+// It returns false if message was canceled
+func (srv Service) claim(key []byte, id string) (bool, error) {
+	err := srv.db.Update(func(txn *badger.Txn) error {
+		// read keys, so concurrent Cancel conflicts with this txn
+		if _, err := txn.Get(key); err != nil {
+			return err
+		}
+		idKey := []byte(idPrefix + id)
+		if _, err := txn.Get(idKey); err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		return txn.Delete(idKey)
+	})
+	if err == badger.ErrKeyNotFound || err == badger.ErrConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unclaim restores scheduled message which was not sent
+func (srv Service) unclaim(key []byte, id string, value []byte) error {
+	return srv.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(key, value); err != nil {
+			return err
+		}
+		return txn.Set([]byte(idPrefix+id), key)
+	})
+}
+
+// sendDue publishes messages scheduled before now and returns wait time for the next one.
+// Message is removed from db before publishing, so it is not sent if Cancel succeeded
+func (srv Service) sendDue(ctx context.Context, now time.Time) (time.Duration, error) {
+	for {
+		var keys, values [][]byte
+		wait := scheduleIdle
+		limit := atKey(now, "")
+		err := srv.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			prefix := []byte(atPrefix)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if bytes.Compare(key[:len(limit)], limit) > 0 {
+					at := time.Unix(0, int64(binary.BigEndian.Uint64(key[len(atPrefix):])))
+					wait = at.Sub(now)
+					break
+				}
+				if len(keys) == scheduleBatch {
+					wait = 0
+					break
+				}
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+				values = append(values, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		for i, key := range keys {
+			id := string(key[len(limit):])
+			var m storedMessage
+			if err = json.Unmarshal(values[i], &m); err != nil {
+				return 0, err
+			}
+			ok, err := srv.claim(key, id)
+			if err != nil {
+				return 0, err
+			} else if !ok {
+				srv.Log.Debugw("Scheduled event canceled", "topic", m.Topic, "id", id)
+				continue
+			}
+			if err = srv.publish(ctx, m.message("")); err != nil {
+				if e := srv.unclaim(key, id, values[i]); e != nil {
+					srv.Log.Errorw("Scheduled event restore error", "topic", m.Topic, "id", id, "error", e)
+				}
+				return 0, err
+			}
+			srv.Log.Debugw("Scheduled event sent", "topic", m.Topic, "id", id)
+		}
+		if wait > 0 {
+			return wait, nil
+		}
+	}
+}
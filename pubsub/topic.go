@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// AnyToken matches single topic segment
+	AnyToken = "*"
+	// RestTokens matches one or more trailing segments
+	RestTokens = ">"
+)
+
+// ErrBadPattern returned when subscription pattern is not valid
+var ErrBadPattern = errors.New("bad topic pattern")
+
+// IsPattern returns true if topic contains wildcards
+func IsPattern(topic string) bool {
+	for _, s := range strings.Split(topic, ".") {
+		if s == AnyToken || s == RestTokens {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPattern checks that pattern has no empty segments and `>` is the last one
+func ValidPattern(pattern string) error {
+	segments := strings.Split(pattern, ".")
+	for i, s := range segments {
+		if s == "" || (s == RestTokens && i != len(segments)-1) {
+			return ErrBadPattern
+		}
+	}
+	return nil
+}
+
+// Match returns true if topic matches pattern.
+// Pattern segments `*` and `>` match one segment and the rest of topic
+func Match(pattern, topic string) bool {
+	ps := strings.Split(pattern, ".")
+	ts := strings.Split(topic, ".")
+	for i, p := range ps {
+		if p == RestTokens {
+			return len(ts) > i
+		}
+		if i >= len(ts) || (p != AnyToken && p != ts[i]) || ts[i] == "" {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// Covers returns true if every topic matching sub matches pattern too
+func Covers(pattern, sub string) bool {
+	ps := strings.Split(pattern, ".")
+	ss := strings.Split(sub, ".")
+	for i, p := range ps {
+		if p == RestTokens {
+			return len(ss) > i
+		}
+		if i >= len(ss) || ss[i] == RestTokens || ss[i] == "" {
+			return false
+		}
+		if p != AnyToken && p != ss[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ss)
+}
@@ -0,0 +1,68 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// Transport delivers published messages to hubs
+type Transport interface {
+	// Publish sends message to all hubs connected to transport
+	Publish(ctx context.Context, m Message) error
+	// Messages returns channel of messages published via transport
+	Messages() <-chan Message
+	// Close stops transport
+	Close() error
+}
+
+// Memory is the in-process transport
+type Memory struct {
+	ch        chan Message
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewMemory creates in-process transport with queue of given size
+func NewMemory(size int) *Memory {
+	return &Memory{
+		ch:        make(chan Message, size),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+// Publish puts message in queue
+func (t Memory) Publish(ctx context.Context, m Message) error {
+	select {
+	case t.ch <- m:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.done:
+		return ErrClosed
+	}
+	return nil
+}
+
+// Messages returns queue channel
+func (t Memory) Messages() <-chan Message {
+	return t.ch
+}
+
+// Close makes Publish return ErrClosed
+func (t Memory) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// isShared returns true if topic messages are published via external transport
+func (srv Service) isShared(topic string) bool {
+	if srv.transport == Transport(srv.local) {
+		return false
+	}
+	for _, p := range srv.Config.Shared {
+		if Match(p, topic) {
+			return true
+		}
+	}
+	return false
+}
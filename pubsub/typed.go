@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+)
+
+// Event holds decoded message payload
+type Event[T any] struct {
+	Topic   string
+	Offset  uint64
+	ID      string
+	Headers map[string]string
+	Value   T
+}
+
+// newEvent returns event of message without value
+func newEvent[T any](m Message) Event[T] {
+	return Event[T]{Topic: m.Topic, Offset: m.Offset, ID: m.ID, Headers: m.Headers}
+}
+
+// Subscribe subscribes on topic and decodes message payloads into T.
+// Messages which cannot be decoded are skipped. Channel is closed when ctx is done or hub is closed
+func Subscribe[T any](ctx context.Context, srv *Service, topic string, opts ...SubscribeOption) (<-chan Event[T], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := srv.Subscribe(ctx, topic, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	events := make(chan Event[T])
+	go func() {
+		defer close(events)
+		defer cancel()
+		for msg := range stream.Messages {
+			ev := newEvent[T](msg)
+			if err := Decode(msg, &ev.Value); err != nil {
+				srv.Log.Errorw("Event decode error", "topic", msg.Topic, "id", msg.ID, "error", err)
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
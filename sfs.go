@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	log "go.uber.org/zap"
@@ -17,6 +18,7 @@ import (
 // Config holds all config vars
 type Config struct {
 	FilesFieldName string `long:"field" default:"files[]" description:"Files form field name"`
+	StripGPS       bool   `long:"strip_gps" description:"Remove GPS data from served images"`
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
@@ -26,6 +28,10 @@ var (
 	ErrNoAnyFile = errors.New("field 'file' does not contains any item")
 	// ErrNoAuth returned on Internal Server Error (no auth for upload)
 	ErrNoAuth = errors.New("This endpoint must be under AuthRequired")
+	// ErrNotReady returned when file is not saved or not scanned yet
+	ErrNotReady = errors.New("file is not ready for download")
+	// ErrInfected returned when virus found in file
+	ErrInfected = errors.New("file is infected")
 )
 
 // Service holds upload service
@@ -52,6 +58,15 @@ func (srv Service) SetupRouter(r *gin.Engine) {
 	})
 	r.GET("/api/files", srv.Files())
 	r.GET("/file/:id", srv.File())
+	r.GET("/api/files/:id/history", srv.History())
+	r.POST("/api/files/:id/copy", srv.Copy())
+	r.POST("/api/import", srv.Import())
+	r.GET("/health", srv.Health())
+}
+
+// SetupAdminRouter adds admin handlers
+func (srv Service) SetupAdminRouter(r gin.IRoutes) {
+	r.GET("/api/stats", srv.Stats())
 }
 
 func (srv Service) HandleMultiPart(c *gin.Context) {
@@ -74,7 +89,11 @@ func (srv Service) HandleMultiPart(c *gin.Context) {
 	for _, file := range files {
 		fileID, err := srv.store.AddFile(token, file)
 		if err != nil {
-			c.String(http.StatusBadRequest, fmt.Sprintf("upload file err: %s", err.Error()))
+			status := http.StatusBadRequest
+			if errors.Is(err, storage.ErrInsufficientStorage) {
+				status = http.StatusInsufficientStorage
+			}
+			c.String(status, fmt.Sprintf("upload file err: %s", err.Error()))
 			return
 		}
 		names[file.Filename] = fileID
@@ -115,8 +134,145 @@ func (srv Service) File() func(c *gin.Context) {
 			c.AbortWithError(http.StatusNotFound, err)
 			return
 		}
+		switch file.State {
+		case storage.StateSaved:
+		case storage.StateInfected:
+			c.AbortWithError(http.StatusForbidden, ErrInfected)
+			return
+		default:
+			c.AbortWithError(http.StatusConflict, ErrNotReady)
+			return
+		}
 		c.Header("Content-Transfer-Encoding", "binary")
 		c.Header("Content-Disposition", "attachment; filename="+file.Name)
-		c.File(filePath)
+		if !srv.Config.StripGPS || !mayHaveGPS(file) {
+			c.File(filePath)
+			return
+		}
+		fh, err := os.Open(filePath)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		defer fh.Close()
+		c.DataFromReader(http.StatusOK, file.Size, file.CType, storage.StripGPS(fh), nil)
+	}
+}
+
+// mayHaveGPS returns false if file metadata is extracted and has no GPS
+func mayHaveGPS(file *storage.File) bool {
+	if file.Meta == nil {
+		return true
+	}
+	return file.Meta.Image != nil && file.Meta.Image.GPS != nil
+}
+
+// History returns file state changes
+func (srv Service) History() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokenIface, _ := c.Get(srv.ContextKey)
+		if tokenIface == nil {
+			c.AbortWithError(http.StatusInternalServerError, ErrNoAuth)
+			return
+		}
+		history, err := srv.store.FileHistory(tokenIface.(string), c.Param("id"))
+		if err != nil {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// CopyRequest holds copy request args
+type CopyRequest struct {
+	Token string `json:"token" form:"token" binding:"required,uuid"`
+}
+
+// Copy makes file copy in the space of given token
+func (srv Service) Copy() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokenIface, _ := c.Get(srv.ContextKey)
+		if tokenIface == nil {
+			c.AbortWithError(http.StatusInternalServerError, ErrNoAuth)
+			return
+		}
+		var req CopyRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		id, err := srv.store.CopyFile(tokenIface.(string), c.Param("id"), req.Token)
+		if err != nil {
+			status := http.StatusNotFound
+			if errors.Is(err, storage.ErrNotSaved) {
+				status = http.StatusConflict
+			} else if errors.Is(err, storage.ErrInsufficientStorage) {
+				status = http.StatusInsufficientStorage
+			}
+			c.AbortWithError(status, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id})
+	}
+}
+
+// ImportRequest holds import request args
+type ImportRequest struct {
+	URL string `json:"url" form:"url" binding:"required"`
+}
+
+// Import starts file download from given url.
+// Download progress is published to user.<token>
+func (srv Service) Import() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokenIface, _ := c.Get(srv.ContextKey)
+		if tokenIface == nil {
+			c.AbortWithError(http.StatusInternalServerError, ErrNoAuth)
+			return
+		}
+		var req ImportRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		id, err := srv.store.ImportFile(tokenIface.(string), req.URL)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrImportHost) {
+				status = http.StatusForbidden
+			} else if errors.Is(err, storage.ErrImportURL) {
+				status = http.StatusBadRequest
+			} else if errors.Is(err, storage.ErrInsufficientStorage) {
+				status = http.StatusInsufficientStorage
+			}
+			c.AbortWithError(status, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id})
+	}
+}
+
+// Health returns storage status, "degraded" if free space is low
+func (srv Service) Health() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, srv.store.Health())
+	}
+}
+
+// Stats returns storage usage stats
+func (srv Service) Stats() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		all, err := srv.store.Stats()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		users, err := srv.store.UsersStats()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"all": all, "users": users, "db": srv.store.DBSize()})
 	}
 }
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const (
+	// backupFormat is the version of backup archive layout
+	backupFormat = 1
+	// backupManifest holds archive metadata
+	backupManifest = "sfs.json"
+	// backupMeta holds badger backup stream
+	backupMeta = "badger.bak"
+	// backupData is the archive dir for DataPath content
+	backupData = "data/"
+	// loadMaxPending is the maxPendingWrites arg of badger Load
+	loadMaxPending = 256
+)
+
+var (
+	// ErrStoreNotEmpty returned by Restore when store already has data
+	ErrStoreNotEmpty = errors.New("store is not empty")
+	// ErrBadBackup returned by Restore when archive is not an sfs backup
+	ErrBadBackup = errors.New("unsupported backup archive")
+)
+
+// BackupInfo holds backup archive manifest
+type BackupInfo struct {
+	Format    int       `json:"format"`
+	Since     uint64    `json:"since"`
+	Next      uint64    `json:"next"`
+	Files     int       `json:"files"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backup writes gzipped tar with badger metadata and file contents.
+// Only records changed since given badger version are included (0 for full backup).
+// Returned info.Next should be used as since for next incremental backup
+func (srv Service) Backup(w io.Writer, since uint64) (*BackupInfo, error) {
+	tmp, err := os.CreateTemp("", "sfs-badger-*.bak")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	version, err := srv.db.Backup(tmp, since)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{Format: backupFormat, Since: since, Next: since, CreatedAt: time.Now()}
+	if version >= since {
+		info.Next = version + 1
+	}
+	// Blobs are renamed into place before metadata changes, so files of records
+	// from backup stream (or newer) are complete
+	var paths []string
+	err = srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if it.Item().Version() < since {
+				continue
+			}
+			f, err := getFileMeta(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			path, err := srv.dataFile(f)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	root := filepath.Clean(srv.Config.DataPath)
+	for _, path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("file %s is out of data path", path)
+		}
+		ok, err := addTarFile(tw, path, backupData+filepath.ToSlash(rel))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			info.Files++
+		}
+	}
+	if _, err = addTarFile(tw, tmp.Name(), backupMeta); err != nil {
+		return nil, err
+	}
+	manifest, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0o644, Size: int64(len(manifest)), ModTime: info.CreatedAt})
+	if err == nil {
+		_, err = tw.Write(manifest)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// addTarFile adds file to archive if it exists
+func addTarFile(tw *tar.Writer, path, name string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return false, err
+	}
+	hdr.Name = name
+	if err = tw.WriteHeader(hdr); err != nil {
+		return false, err
+	}
+	_, err = io.Copy(tw, f)
+	return err == nil, err
+}
+
+// Restore loads backup archive made by Backup.
+// Full backup is loaded into empty store only, unless force is set.
+// In that case store content is removed before load.
+// Incremental backups are loaded over existing data
+func (srv Service) Restore(r io.Reader, force bool) (*BackupInfo, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	// manifest is written last, so read data into temp dir first
+	tmpDir, err := os.MkdirTemp(filepath.Dir(filepath.Clean(srv.Config.DataPath)), ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var info *BackupInfo
+	var files []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: bad entry %q", ErrBadBackup, hdr.Name)
+		}
+		if hdr.Name == backupManifest {
+			info = &BackupInfo{}
+			if err = json.NewDecoder(tr).Decode(info); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dst := filepath.Join(tmpDir, name)
+		if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err = writeFileAtomic(dst, tr, nil); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(hdr.Name, backupData) {
+			files = append(files, name)
+		}
+	}
+	if info == nil || info.Format != backupFormat {
+		return nil, ErrBadBackup
+	}
+
+	if info.Since == 0 {
+		empty, err := srv.isEmpty()
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			if !force {
+				return nil, ErrStoreNotEmpty
+			}
+			srv.Log.Warnw("Drop store content")
+			if err = srv.db.DropAll(); err != nil {
+				return nil, err
+			}
+			if err = removeContent(srv.Config.DataPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	meta, err := os.Open(filepath.Join(tmpDir, backupMeta))
+	if err != nil {
+		return nil, err
+	}
+	defer meta.Close()
+	if err = srv.db.Load(meta, loadMaxPending); err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		dst := filepath.Join(srv.Config.DataPath, strings.TrimPrefix(name, filepath.FromSlash(backupData)))
+		if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(filepath.Join(tmpDir, name), dst); err != nil {
+			return nil, err
+		}
+	}
+	srv.Log.Infow("Store restored", "since", info.Since, "files", len(files))
+	if err = srv.migrate(); err != nil {
+		return nil, err
+	}
+	return info, srv.recoverFiles()
+}
+
+// isEmpty returns true if there are no file records in db and no files in DataPath
+func (srv Service) isEmpty() (bool, error) {
+	empty := true
+	err := srv.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("file.")
+		it.Seek(prefix)
+		empty = !it.ValidForPrefix(prefix)
+		return nil
+	})
+	if err != nil || !empty {
+		return empty, err
+	}
+	entries, err := os.ReadDir(srv.Config.DataPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// removeContent removes all entries of dir
+func removeContent(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package storage
+
+import (
+	"os"
+)
+
+// diskUsage returns file size
+func diskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
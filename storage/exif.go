@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// EXIF tags
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagGPS         = 0x8825
+
+	tagGPSLatRef = 1
+	tagGPSLat    = 2
+	tagGPSLonRef = 3
+	tagGPSLon    = 4
+)
+
+var (
+	// ErrNotJPEG returned when data is not a jpeg image
+	ErrNotJPEG = errors.New("not a jpeg image")
+
+	exifHeader = []byte("Exif\x00\x00")
+	// tiffTypeSize holds size of tiff value types
+	tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+)
+
+// jpegSegment holds jpeg marker and its data
+type jpegSegment struct {
+	Marker byte
+	Data   []byte
+}
+
+// readJPEGSegment reads marker segment. Data is not read for SOS and markers without length
+func readJPEGSegment(r *bufio.Reader) (*jpegSegment, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if b != 0xFF {
+		return nil, ErrNotJPEG
+	}
+	marker, err := r.ReadByte()
+	for err == nil && marker == 0xFF { // fill bytes
+		marker, err = r.ReadByte()
+	}
+	if err != nil {
+		return nil, err
+	}
+	seg := &jpegSegment{Marker: marker}
+	if marker == 0xDA || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+		return seg, nil
+	}
+	var size uint16
+	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 2 {
+		return nil, ErrNotJPEG
+	}
+	seg.Data = make([]byte, size-2)
+	_, err = io.ReadFull(r, seg.Data)
+	return seg, err
+}
+
+// isSOF returns true for start of frame markers
+func isSOF(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// parseJPEG reads image size and EXIF data
+func parseJPEG(r io.Reader) (*ImageMeta, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, ErrNotJPEG
+	}
+	rv := &ImageMeta{}
+	for {
+		seg, err := readJPEGSegment(br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case seg.Marker == 0xE1 && bytes.HasPrefix(seg.Data, exifHeader):
+			if t, err := newTIFF(seg.Data[len(exifHeader):]); err == nil {
+				t.imageMeta(rv)
+			}
+		case isSOF(seg.Marker) && len(seg.Data) >= 5:
+			rv.Height = int(binary.BigEndian.Uint16(seg.Data[1:3]))
+			rv.Width = int(binary.BigEndian.Uint16(seg.Data[3:5]))
+			return rv, nil
+		case seg.Marker == 0xDA || seg.Marker == 0xD9:
+			return rv, nil
+		}
+	}
+}
+
+// tiff is the EXIF data reader
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is the IFD entry
+type tiffEntry struct {
+	Pos   uint32 // entry offset
+	Tag   uint16
+	Type  uint16
+	Count uint32
+}
+
+func newTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, ErrNotJPEG
+	}
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrNotJPEG
+	}
+	return t, nil
+}
+
+// hasIFD returns true if IFD count at offset is within data
+func (t tiff) hasIFD(offset uint32) bool {
+	return uint64(offset)+2 <= uint64(len(t.data))
+}
+
+// entries returns entries of IFD at offset which are within data
+func (t tiff) entries(offset uint32) []tiffEntry {
+	if !t.hasIFD(offset) {
+		return nil
+	}
+	count := uint64(t.order.Uint16(t.data[offset:]))
+	var rv []tiffEntry
+	for i := uint64(0); i < count; i++ {
+		pos := uint64(offset) + 2 + i*12
+		if pos+12 > uint64(len(t.data)) {
+			break
+		}
+		rv = append(rv, tiffEntry{
+			Pos:   uint32(pos),
+			Tag:   t.order.Uint16(t.data[pos:]),
+			Type:  t.order.Uint16(t.data[pos+2:]),
+			Count: t.order.Uint32(t.data[pos+4:]),
+		})
+	}
+	return rv
+}
+
+// value returns entry value bytes
+func (t tiff) value(e tiffEntry) []byte {
+	size := uint64(tiffTypeSize[e.Type]) * uint64(e.Count)
+	start := uint64(e.Pos) + 8
+	if size > 4 {
+		start = uint64(t.order.Uint32(t.data[e.Pos+8:]))
+	}
+	if start+size > uint64(len(t.data)) {
+		return nil
+	}
+	return t.data[start : start+size]
+}
+
+func (t tiff) uint(e tiffEntry) uint32 {
+	v := t.value(e)
+	switch {
+	case e.Type == 3 && len(v) >= 2:
+		return uint32(t.order.Uint16(v))
+	case e.Type == 4 && len(v) >= 4:
+		return t.order.Uint32(v)
+	}
+	return 0
+}
+
+func (t tiff) string(e tiffEntry) string {
+	return strings.TrimRight(string(t.value(e)), "\x00 ")
+}
+
+// degrees converts 3 rationals (deg, min, sec) to degrees
+func (t tiff) degrees(e tiffEntry) float64 {
+	v := t.value(e)
+	if e.Type != 5 || len(v) < 24 {
+		return 0
+	}
+	var rv float64
+	for i, div := range []float64{1, 60, 3600} {
+		num, den := t.order.Uint32(v[i*8:]), t.order.Uint32(v[i*8+4:])
+		if den != 0 {
+			rv += float64(num) / float64(den) / div
+		}
+	}
+	return rv
+}
+
+// gpsOffset returns GPS IFD offset or 0
+func (t tiff) gpsOffset() uint32 {
+	for _, e := range t.entries(t.order.Uint32(t.data[4:])) {
+		if e.Tag == tagGPS {
+			return t.uint(e)
+		}
+	}
+	return 0
+}
+
+// imageMeta fills meta from IFD0 and GPS IFD
+func (t tiff) imageMeta(meta *ImageMeta) {
+	for _, e := range t.entries(t.order.Uint32(t.data[4:])) {
+		switch e.Tag {
+		case tagMake:
+			meta.Make = t.string(e)
+		case tagModel:
+			meta.Model = t.string(e)
+		case tagOrientation:
+			meta.Orientation = int(t.uint(e))
+		}
+	}
+	offset := t.gpsOffset()
+	if offset == 0 {
+		return
+	}
+	entries := t.entries(offset)
+	if len(entries) == 0 {
+		return
+	}
+	gps := &GPS{}
+	var latRef, lonRef string
+	for _, e := range entries {
+		switch e.Tag {
+		case tagGPSLatRef:
+			latRef = t.string(e)
+		case tagGPSLat:
+			gps.Lat = t.degrees(e)
+		case tagGPSLonRef:
+			lonRef = t.string(e)
+		case tagGPSLon:
+			gps.Lon = t.degrees(e)
+		}
+	}
+	if latRef == "S" {
+		gps.Lat = -gps.Lat
+	}
+	if lonRef == "W" {
+		gps.Lon = -gps.Lon
+	}
+	meta.GPS = gps
+}
+
+// stripGPS zeroes GPS IFD entries and their values.
+// GPS IFD out of data is treated as absent
+func (t tiff) stripGPS() bool {
+	offset := t.gpsOffset()
+	if offset == 0 || !t.hasIFD(offset) {
+		return false
+	}
+	for _, e := range t.entries(offset) {
+		if v := t.value(e); v != nil {
+			copy(v, make([]byte, len(v)))
+		}
+		copy(t.data[e.Pos:e.Pos+12], make([]byte, 12))
+	}
+	t.order.PutUint16(t.data[offset:], 0)
+	return true
+}
+
+// StripGPS returns reader of jpeg image with GPS data removed from EXIF.
+// Data size is not changed. Reader of source data is returned if r is not a jpeg image
+func StripGPS(r io.Reader) io.Reader {
+	// bufio may read ahead, so all data read from r is kept in head
+	var head bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(r, &head))
+	rest := func() io.Reader {
+		return io.MultiReader(bytes.NewReader(head.Bytes()), r)
+	}
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return rest()
+	}
+	for {
+		seg, err := readJPEGSegment(br)
+		if err != nil || seg.Marker == 0xDA || seg.Marker == 0xD9 || isSOF(seg.Marker) {
+			return rest()
+		}
+		if seg.Marker != 0xE1 || !bytes.HasPrefix(seg.Data, exifHeader) {
+			continue
+		}
+		end := head.Len() - br.Buffered()
+		data := head.Bytes()[end-len(seg.Data)+len(exifHeader) : end]
+		if t, err := newTIFF(data); err == nil {
+			t.stripGPS()
+		}
+		return rest()
+	}
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const (
+	// pdfMaxRead is the max size of pdf data searched for metadata
+	pdfMaxRead = 32 << 20
+	// id3MaxRead is the max size of ID3 tag data searched for text frames
+	id3MaxRead = 1 << 20
+)
+
+// ErrNoMeta returned when file format is not supported by extractor
+var ErrNoMeta = errors.New("unsupported format")
+
+// Meta holds format specific file metadata
+type Meta struct {
+	Image *ImageMeta `json:"image,omitempty"`
+	PDF   *PDFMeta   `json:"pdf,omitempty"`
+	Audio *AudioMeta `json:"audio,omitempty"`
+}
+
+// ImageMeta holds JPEG size and EXIF data
+type ImageMeta struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Orientation int    `json:"orientation,omitempty"`
+	Make        string `json:"make,omitempty"`
+	Model       string `json:"model,omitempty"`
+	GPS         *GPS   `json:"gps,omitempty"`
+}
+
+// GPS holds image location in degrees
+type GPS struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// PDFMeta holds PDF document info
+type PDFMeta struct {
+	Pages int    `json:"pages"`
+	Title string `json:"title,omitempty"`
+}
+
+// AudioMeta holds WAV or MP3 stream info and tags
+type AudioMeta struct {
+	Codec      string  `json:"codec"`
+	Duration   float64 `json:"duration"` // seconds
+	SampleRate int     `json:"sample_rate"`
+	Channels   int     `json:"channels"`
+	Bitrate    int     `json:"bitrate"` // bits per second
+	Title      string  `json:"title,omitempty"`
+	Artist     string  `json:"artist,omitempty"`
+}
+
+// ExtractMeta detects file format by content and reads its metadata
+func ExtractMeta(path string) (*Meta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var magic [12]byte
+	n, _ := io.ReadFull(f, magic[:])
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := magic[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		m, err := parseJPEG(f)
+		return &Meta{Image: m}, err
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		m, err := parsePDF(f)
+		return &Meta{PDF: m}, err
+	case n == 12 && string(head[:4]) == "RIFF" && string(head[8:]) == "WAVE":
+		m, err := parseWAV(f)
+		return &Meta{Audio: m}, err
+	case bytes.HasPrefix(head, []byte("ID3")) || n > 1 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		m, err := parseMP3(f, fi.Size())
+		return &Meta{Audio: m}, err
+	}
+	return nil, ErrNoMeta
+}
+
+// resumeMeta extracts metadata of saved files which were not processed before restart,
+// e.g. saved by recoverFiles. Files are processed one by one until ctx is done
+func (srv Service) resumeMeta(ctx context.Context) {
+	ids, err := srv.fileIDs(func(f *File) bool { return f.State == StateSaved && f.Meta == nil })
+	if err != nil {
+		srv.Log.Errorw("Meta queue load error", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err = srv.extractMeta(id); err != nil {
+			srv.Log.Errorw("File meta error", "id", id, "error", err)
+		}
+	}
+}
+
+// extractMeta saves metadata of file content.
+// Content which cannot be parsed gets empty metadata, so only io errors are retried
+func (srv Service) extractMeta(id string) error {
+	var f *File
+	err := srv.db.View(func(txn *badger.Txn) (err error) {
+		f, err = getFileMeta(txn, id)
+		return
+	})
+	if err != nil || f.Meta != nil {
+		return err
+	}
+	path, err := srv.dataFile(f)
+	if err != nil {
+		return err
+	}
+	meta, err := ExtractMeta(path)
+	var pathErr *fs.PathError
+	if err == ErrNoMeta {
+		return nil
+	} else if errors.As(err, &pathErr) {
+		return err
+	} else if err != nil {
+		srv.Log.Warnw("File meta parse error", "id", id, "error", err)
+		meta = &Meta{}
+	}
+	srv.Log.Debugw("File meta", "id", id, "meta", meta)
+	return srv.update(func(txn *badger.Txn) error {
+		f, err := getFileMeta(txn, id)
+		if err != nil {
+			return err
+		}
+		f.Meta = meta
+		return setFileMeta(txn, f)
+	})
+}
+
+var (
+	pdfPage  = regexp.MustCompile(`/Type\s*/Page[^s]`)
+	pdfCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfTitle = regexp.MustCompile(`/Title\s*(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)`)
+)
+
+// parsePDF counts pages and finds title in uncompressed PDF objects
+func parsePDF(r io.Reader) (*PDFMeta, error) {
+	data, err := io.ReadAll(io.LimitReader(r, pdfMaxRead))
+	if err != nil {
+		return nil, err
+	}
+	rv := &PDFMeta{Pages: len(pdfPage.FindAll(data, -1))}
+	// root Pages has max count
+	for _, m := range pdfCount.FindAllSubmatch(data, -1) {
+		for _, num := range m[1:] {
+			if n, err := strconv.Atoi(string(num)); err == nil && n > rv.Pages {
+				rv.Pages = n
+			}
+		}
+	}
+	if m := pdfTitle.FindSubmatch(data); m != nil {
+		rv.Title = pdfString(m[1])
+	}
+	return rv, nil
+}
+
+// pdfString decodes literal (text) or hex <FEFF...> string
+func pdfString(s []byte) string {
+	var raw []byte
+	if s[0] == '<' {
+		hex := bytes.Join(bytes.Fields(s[1:len(s)-1]), nil)
+		for i := 0; i+1 < len(hex); i += 2 {
+			b, err := strconv.ParseUint(string(hex[i:i+2]), 16, 8)
+			if err != nil {
+				break
+			}
+			raw = append(raw, byte(b))
+		}
+	} else {
+		s = s[1 : len(s)-1]
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					raw = append(raw, '\n')
+				case 'r':
+					raw = append(raw, '\r')
+				case 't':
+					raw = append(raw, '\t')
+				default:
+					raw = append(raw, s[i])
+				}
+				continue
+			}
+			raw = append(raw, s[i])
+		}
+	}
+	if bytes.HasPrefix(raw, []byte{0xFE, 0xFF}) {
+		return decodeUTF16(raw[2:], binary.BigEndian)
+	}
+	return string(raw)
+}
+
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// wavCodecs holds names of WAVE format codes
+var wavCodecs = map[uint16]string{1: "pcm", 3: "float", 6: "alaw", 7: "mulaw", 0xFFFE: "extensible"}
+
+// parseWAV reads fmt and data chunks of RIFF WAVE
+func parseWAV(r io.Reader) (*AudioMeta, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(12); err != nil {
+		return nil, err
+	}
+	rv := &AudioMeta{}
+	var byteRate uint32
+	for {
+		var hdr struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		switch string(hdr.ID[:]) {
+		case "fmt ":
+			var fmtChunk struct {
+				Format     uint16
+				Channels   uint16
+				SampleRate uint32
+				ByteRate   uint32
+			}
+			if err := binary.Read(br, binary.LittleEndian, &fmtChunk); err != nil {
+				return nil, err
+			}
+			rv.Codec = wavCodecs[fmtChunk.Format]
+			if rv.Codec == "" {
+				rv.Codec = "0x" + strconv.FormatUint(uint64(fmtChunk.Format), 16)
+			}
+			rv.Channels = int(fmtChunk.Channels)
+			rv.SampleRate = int(fmtChunk.SampleRate)
+			byteRate = fmtChunk.ByteRate
+			rv.Bitrate = int(byteRate * 8)
+			hdr.Size -= 12
+		case "data":
+			if byteRate > 0 {
+				rv.Duration = float64(hdr.Size) / float64(byteRate)
+			}
+			return rv, nil
+		}
+		// chunks are word aligned
+		if _, err := br.Discard(int(hdr.Size + hdr.Size%2)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mp3Bitrates holds Layer III bitrates (kbps) for MPEG1 and MPEG2/2.5
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// mp3SampleRates holds sample rates for MPEG versions 2.5, reserved, 2, 1
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+// parseMP3 reads ID3v2 tags and first frame header.
+// Duration is estimated for constant bitrate
+func parseMP3(r io.Reader, size int64) (*AudioMeta, error) {
+	br := bufio.NewReader(r)
+	rv := &AudioMeta{Codec: "mp3"}
+	var offset int64
+	var hdr [10]byte
+	if b, err := br.Peek(10); err == nil && string(b[:3]) == "ID3" {
+		copy(hdr[:], b)
+		tagSize := int64(syncsafe(hdr[6:10]))
+		if 10+tagSize > size {
+			return nil, ErrNoMeta
+		}
+		// frames after id3MaxRead (e.g. large pictures) are skipped
+		tag := make([]byte, 10+min(tagSize, id3MaxRead))
+		if _, err := io.ReadFull(br, tag); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(int(10 + tagSize - int64(len(tag)))); err != nil {
+			return nil, err
+		}
+		offset = 10 + tagSize
+		parseID3(tag[10:], hdr[3], rv)
+	}
+	// find frame sync
+	for {
+		b, err := br.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0xFF && b[1]&0xE0 == 0xE0 {
+			version := b[1] >> 3 & 3
+			layer := b[1] >> 1 & 3
+			bitrate := b[2] >> 4
+			rate := b[2] >> 2 & 3
+			if version != 1 && layer == 1 && bitrate != 0 && bitrate != 15 && rate != 3 {
+				table := 0
+				if version != 3 {
+					table = 1
+				}
+				rv.Bitrate = mp3Bitrates[table][bitrate] * 1000
+				rv.SampleRate = mp3SampleRates[version][rate]
+				rv.Channels = 2
+				if b[3]>>6 == 3 {
+					rv.Channels = 1
+				}
+				rv.Duration = float64((size-offset)*8) / float64(rv.Bitrate)
+				return rv, nil
+			}
+		}
+		if _, err = br.Discard(1); err != nil {
+			return nil, err
+		}
+		offset++
+	}
+}
+
+// syncsafe decodes ID3 size (7 bits per byte)
+func syncsafe(b []byte) uint32 {
+	var rv uint32
+	for _, c := range b {
+		rv = rv<<7 | uint32(c&0x7F)
+	}
+	return rv
+}
+
+// parseID3 reads title and artist from ID3v2.3/2.4 text frames
+func parseID3(tag []byte, version byte, meta *AudioMeta) {
+	for len(tag) >= 10 && tag[0] != 0 {
+		id := string(tag[:4])
+		size := binary.BigEndian.Uint32(tag[4:8])
+		if version >= 4 {
+			size = syncsafe(tag[4:8])
+		}
+		if int(size) > len(tag)-10 {
+			return
+		}
+		body := tag[10 : 10+size]
+		tag = tag[10+size:]
+		if len(body) == 0 {
+			continue
+		}
+		switch id {
+		case "TIT2":
+			meta.Title = id3Text(body)
+		case "TPE1":
+			meta.Artist = id3Text(body)
+		}
+	}
+}
+
+// id3Text decodes text frame body
+func id3Text(b []byte) string {
+	enc, text := b[0], b[1:]
+	switch enc {
+	case 1: // UTF-16 with BOM
+		if bytes.HasPrefix(text, []byte{0xFF, 0xFE}) {
+			return trimNull(decodeUTF16(text[2:], binary.LittleEndian))
+		} else if bytes.HasPrefix(text, []byte{0xFE, 0xFF}) {
+			return trimNull(decodeUTF16(text[2:], binary.BigEndian))
+		}
+	case 2: // UTF-16BE
+		return trimNull(decodeUTF16(text, binary.BigEndian))
+	case 0: // ISO-8859-1
+		r := make([]rune, len(text))
+		for i, c := range text {
+			r[i] = rune(c)
+		}
+		return trimNull(string(r))
+	}
+	return trimNull(string(text))
+}
+
+func trimNull(s string) string {
+	return string(bytes.TrimRight([]byte(s), "\x00"))
+}
@@ -1,30 +1,52 @@
 package storage
 
-func (srv Service) HandlersRun() {
+import (
+	"context"
+	"errors"
+	"sync"
 
-	stream, err := srv.pubsub.Subscribe("file")
-	if err != nil {
-		srv.Log.Errorw("Failed to subscribe", "error", err)
-		return
-	}
-	defer stream.Unsubscribe()
+	"github.com/LeKovr/sfs/pubsub"
+)
 
-	srv.Log.Debugw("Subscribed on file")
-	for {
-		select {
-		case msg, ok := <-stream.Messages:
-			if !ok {
-				// Channel closed,exit
-				srv.Log.Debugw("Subscription closed")
-				return
-			}
-			srv.Log.Debugw("Received event", "data", string(msg.Payload))
+func (srv Service) HandlersRun() {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-srv.quit
+		cancel()
+	}()
+	if srv.scanner != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.resumeScans(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.resumeMeta(ctx)
+	}()
+	srv.Log.Debugw("Subscribe on file")
+	err := pubsub.Handle(ctx, srv.pubsub, "file", srv.handleEvent, pubsub.Queue("storage"))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		srv.Log.Errorw("File handler error", "error", err)
+	}
+	srv.Log.Debugw("Subscription closed")
+}
 
-			// Process
-		case <-srv.quit:
-			break
-		}
+// handleEvent processes file event, returned error makes it retried
+func (srv Service) handleEvent(ctx context.Context, msg pubsub.Event[UserEvent]) error {
+	ev := msg.Value
+	srv.Log.Debugw("Received event", "event", ev)
+	if ev.State == string(StateScanning) && srv.scanner != nil {
+		return srv.processScan(ctx, ev.FileID)
+	} else if ev.State == string(StateSaved) {
+		return srv.extractMeta(ev.FileID)
 	}
+	return nil
 }
 
 func (srv Service) HandlersClose() {
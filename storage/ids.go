@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// IDGenerator generates new file IDs
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// newIDGenerator returns generator for given scheme
+func newIDGenerator(scheme string, db *badger.DB) (IDGenerator, error) {
+	switch scheme {
+	case "", "seq":
+		seq, err := db.GetSequence(seqFileID, 1)
+		if err != nil {
+			return nil, err
+		}
+		return SeqID{seq}, nil
+	case "ulid":
+		return ULID{}, nil
+	case "rand":
+		return RandomID{Size: 10}, nil
+	}
+	return nil, fmt.Errorf("unknown id scheme: %s", scheme)
+}
+
+// SeqID generates zero-padded sequence numbers (0000001).
+// Sequence is shared, so concurrent calls do not conflict on its key
+type SeqID struct {
+	seq *badger.Sequence
+}
+
+// NewID returns next sequence number
+func (g SeqID) NewID() (string, error) {
+	num, err := g.seq.Next()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%07d", num), nil
+}
+
+// Close releases sequence
+func (g SeqID) Close() error {
+	return g.seq.Release()
+}
+
+// crockford is the ULID alphabet
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates lexicographically sortable IDs (see https://github.com/ulid/spec)
+type ULID struct{}
+
+// NewID returns 26 chars of 48 bit timestamp (ms) and 80 bit of randomness
+func (ULID) NewID() (string, error) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// 128 bits as 26 base32 chars, first char holds 3 bits
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+// randomEncoding is the lowercase base32 without padding
+var randomEncoding = base32.NewEncoding(strings.ToLower("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567")).WithPadding(base32.NoPadding)
+
+// RandomID generates random base32 strings
+type RandomID struct {
+	// Size is the number of random bytes
+	Size int
+}
+
+// NewID returns random ID
+func (g RandomID) NewID() (string, error) {
+	b := make([]byte, g.Size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return randomEncoding.EncodeToString(b), nil
+}
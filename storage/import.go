@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+const (
+	// progressPeriod is the min period of import progress events
+	progressPeriod = time.Second
+	// importName is the name of imported file if url has no one
+	importName = "index.html"
+)
+
+var (
+	// ErrNotSaved returned when file content is not ready for copy
+	ErrNotSaved = errors.New("file is not saved")
+	// ErrImportURL returned when import url is not http(s) one
+	ErrImportURL = errors.New("unsupported import url")
+	// ErrImportHost returned when import url host is not in allowed list
+	ErrImportHost = errors.New("import host is not allowed")
+	// ErrImportSize returned when imported file exceeds size limit
+	ErrImportSize = errors.New("import size limit exceeded")
+)
+
+// CopyFile makes a copy of token's file in dstToken's space.
+// Copy shares file content with source (via hardlink) if possible
+func (srv Service) CopyFile(token, id, dstToken string) (string, error) {
+	src, srcPath, err := srv.File(token, id)
+	if err != nil {
+		return "", err
+	}
+	if src.State != StateSaved {
+		return "", ErrNotSaved
+	}
+	f := File{
+		Name:  src.Name,
+		Size:  src.Size,
+		CType: src.CType,
+		SHA1:  src.SHA1,
+		Meta:  src.Meta,
+		Token: dstToken,
+		State: StateReceived,
+	}
+	dst, err := srv.addFile(&f, "copy of "+id)
+	if err != nil {
+		return "", err
+	}
+	srv.Log.Debugw("Copy file", "id", id, "copy", f.ID, "token", dstToken)
+	err = os.Link(srcPath, dst)
+	if err == nil {
+		// content is counted in source disk usage
+		err = syncDir(filepath.Dir(dst))
+	} else {
+		err = copyFile(srcPath, dst)
+		if err == nil {
+			err = srv.setDiskSize(f.ID, dst)
+		}
+	}
+	if err == nil {
+		err = srv.FileStateChange(f.ID, StateSaved, "copy saved")
+	}
+	if err != nil {
+		srv.fileFailed(&f, err)
+		return "", err
+	}
+	return f.ID, nil
+}
+
+// copyFile copies file content
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileAtomic(dst, in, nil)
+}
+
+// ImportFile checks url and starts its download into token's space.
+// Progress is published as UserEvent with type "import"
+func (srv Service) ImportFile(token, rawURL string) (string, error) {
+	u, err := srv.checkImportURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = importName
+	}
+	f := File{
+		Name:  name,
+		Token: token,
+		State: StateReceived,
+	}
+	dst, err := srv.addFile(&f, "import from "+u.String())
+	if err != nil {
+		return "", err
+	}
+	srv.Log.Debugw("Import file", "id", f.ID, "url", u.String())
+	go func() {
+		err := srv.importFile(&f, u.String(), dst)
+		if err != nil {
+			srv.fileFailed(&f, err)
+		}
+	}()
+	return f.ID, nil
+}
+
+// checkImportURL parses url and checks if its host is allowed
+func (srv Service) checkImportURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImportURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrImportURL
+	}
+	for _, host := range srv.Config.ImportHosts {
+		if host == u.Hostname() || host == u.Host {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrImportHost, u.Host)
+}
+
+// importFile downloads file content and updates its metadata
+func (srv Service) importFile(f *File, rawURL, dst string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.Config.ImportTimeout)
+	defer cancel()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			_, err := srv.checkImportURL(req.URL.String())
+			return err
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import status: %s", resp.Status)
+	}
+	limit := srv.Config.ImportMaxSize << 20
+	if resp.ContentLength > limit {
+		return ErrImportSize
+	}
+	if resp.ContentLength > 0 {
+		if err = srv.checkSpace(resp.ContentLength); err != nil {
+			return err
+		}
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		f.Name = path.Base(params["filename"])
+	}
+	f.CType = resp.Header.Get("Content-Type")
+	f.Size = resp.ContentLength
+
+	pr := &progressReader{r: resp.Body, limit: limit, publish: func(size int64) {
+		err := srv.pubsub.Publish(context.Background(), "user."+f.Token, UserEvent{Type: "import", FileID: f.ID, State: string(StateReceived), Size: size})
+		if err != nil {
+			srv.Log.Warnw("Import progress publish error", "file", f.ID, "error", err)
+		}
+	}, check: func(size int64) error {
+		// written bytes already reduce free space
+		var rest int64
+		if resp.ContentLength > size {
+			rest = resp.ContentLength - size
+		}
+		return srv.checkSpace(rest)
+	}}
+	err = writeFileAtomic(dst, pr, nil)
+	if err != nil {
+		return err
+	}
+	pr.publish(pr.size)
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	err = srv.update(func(txn *badger.Txn) error {
+		meta, err := getFileMeta(txn, f.ID)
+		if err != nil {
+			return err
+		}
+		meta.Name = f.Name
+		meta.CType = f.CType
+		meta.Size = pr.size
+		meta.DiskSize = diskUsage(fi)
+		return setFileMeta(txn, meta)
+	})
+	if err != nil {
+		return err
+	}
+	return srv.FileStateChange(f.ID, srv.savedState(), "import saved")
+}
+
+// progressReader calls publish with bytes count while reading
+// and fails if more than limit bytes read or check returns error
+type progressReader struct {
+	r       io.Reader
+	size    int64
+	limit   int64
+	last    time.Time
+	publish func(size int64)
+	check   func(size int64) error
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.size += int64(n)
+	if pr.size > pr.limit {
+		return n, ErrImportSize
+	}
+	if now := time.Now(); now.Sub(pr.last) >= progressPeriod {
+		pr.last = now
+		if pr.check != nil {
+			if e := pr.check(pr.size); e != nil {
+				return n, e
+			}
+		}
+		pr.publish(pr.size)
+	}
+	return n, err
+}
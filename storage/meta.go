@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// metaVersion is the version of File record written by this code.
+// Increment it with adding converter from previous version to metaUpgrades
+const metaVersion = 1
+
+var (
+	// ErrMetaVersion returned when record was written by newer code
+	ErrMetaVersion = errors.New("unsupported metadata version")
+
+	// keySchema holds number of applied migrations
+	keySchema = []byte("meta.schema")
+)
+
+// record is an envelope of File stored in badger.
+// Value looks like {"v":1,"file":{"id":"0000001",...}}
+type record struct {
+	Version int             `json:"v"`
+	File    json.RawMessage `json:"file"`
+}
+
+// metaUpgrades holds converters of File json from version (key) to next one.
+// Used on record read, so stored records need no migration
+var metaUpgrades = map[int]func(json.RawMessage) (json.RawMessage, error){}
+
+// migrations are applied once on startup, in order
+var migrations = []struct {
+	Name string
+	Func func(srv Service) error
+}{
+	{"gob to json", migrateGob},
+	{"usage stats", rebuildStats},
+}
+
+func getFileMeta(txn *badger.Txn, id string) (*File, error) {
+	val, err := txn.Get([]byte("file." + id))
+	if err != nil {
+		return nil, err
+	}
+	var f *File
+	err = val.Value(func(val []byte) error {
+		f, err = decodeFileMeta(val)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// setFileMeta saves file metadata and updates usage stats
+func setFileMeta(txn *badger.Txn, f *File) error {
+	old, err := getFileMeta(txn, f.ID)
+	if err == badger.ErrKeyNotFound {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+	data, err := encodeFileMeta(f)
+	if err != nil {
+		return err
+	}
+	err = txn.Set([]byte("file."+f.ID), data)
+	if err != nil {
+		return err
+	}
+	return updateStats(txn, old, f)
+}
+
+func encodeFileMeta(f *File) ([]byte, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record{Version: metaVersion, File: data})
+}
+
+func decodeFileMeta(data []byte) (*File, error) {
+	var rec record
+	err := json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Version < 1 || rec.Version > metaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrMetaVersion, rec.Version)
+	}
+	for v := rec.Version; v < metaVersion; v++ {
+		rec.File, err = metaUpgrades[v](rec.File)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade from v%d: %w", v, err)
+		}
+	}
+	var f File
+	err = json.Unmarshal(rec.File, &f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// migrate applies migrations which were not applied yet
+func (srv Service) migrate() error {
+	var applied uint64
+	err := srv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(keySchema)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			applied = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for i := int(applied); i < len(migrations); i++ {
+		m := migrations[i]
+		srv.Log.Infow("Apply migration", "step", i+1, "name", m.Name)
+		if err = m.Func(srv); err != nil {
+			return fmt.Errorf("migration %q: %w", m.Name, err)
+		}
+		err = srv.db.Update(func(txn *badger.Txn) error {
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], uint64(i+1))
+			return txn.Set(keySchema, buf[:])
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateGob converts gob encoded File records into json envelope
+func migrateGob(srv Service) error {
+	wb := srv.db.NewWriteBatch()
+	defer wb.Cancel()
+	count := 0
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				if len(val) > 0 && val[0] == '{' {
+					// already json
+					return nil
+				}
+				var f File
+				if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&f); err != nil {
+					return fmt.Errorf("key %s: %w", item.Key(), err)
+				}
+				data, err := encodeFileMeta(&f)
+				if err != nil {
+					return err
+				}
+				count++
+				return wb.Set(item.KeyCopy(nil), data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	srv.Log.Infow("Converted gob records", "count", count)
+	return wb.Flush()
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/LeKovr/sfs/pubsub"
+)
+
+const (
+	// ScanClean is the status of file without viruses
+	ScanClean = "clean"
+	// ScanInfected is the status of file with virus found
+	ScanInfected = "infected"
+
+	// clamdChunk is the size of INSTREAM chunk
+	clamdChunk = 64 << 10
+)
+
+// ErrScan returned when scanner reply is not recognized
+var ErrScan = errors.New("scan error")
+
+// ScanResult holds file scan result
+type ScanResult struct {
+	Engine    string    `json:"engine"`
+	Status    string    `json:"status"`
+	Signature string    `json:"signature,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Scanner checks file content for viruses
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+// Clamd is the Scanner which uses clamd INSTREAM command
+type Clamd struct {
+	Network string
+	Addr    string
+}
+
+// NewClamd creates Clamd for address like tcp://host:3310 or unix:///path/clamd.sock
+func NewClamd(addr string) (*Clamd, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return &Clamd{"tcp", u.Host}, nil
+	case "unix":
+		return &Clamd{"unix", u.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported clamd address: %s", addr)
+}
+
+// Scan streams r to clamd and parses its reply
+func (cd Clamd) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, cd.Network, cd.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// unblock conn io when ctx is canceled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	w := bufio.NewWriter(conn)
+	if _, err = w.WriteString("zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, clamdChunk)
+	var size [4]byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := w.Write(size[:]); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err = w.Write(size[:]); err != nil {
+		return nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses "stream: OK" or "stream: Sig-Name FOUND"
+func parseClamdReply(reply string) (*ScanResult, error) {
+	rv := &ScanResult{Engine: "clamd", At: time.Now()}
+	msg := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case msg == "OK":
+		rv.Status = ScanClean
+	case strings.HasSuffix(msg, " FOUND"):
+		rv.Status = ScanInfected
+		rv.Signature = strings.TrimSuffix(msg, " FOUND")
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrScan, reply)
+	}
+	return rv, nil
+}
+
+// savedState returns state of file with content saved
+func (srv Service) savedState() State {
+	if srv.scanner != nil {
+		return StateScanning
+	}
+	return StateSaved
+}
+
+// scanFile checks file content and sets its state to saved or infected.
+// Infected file content is moved to QuarantinePath
+func (srv Service) scanFile(ctx context.Context, id string) error {
+	var f *File
+	err := srv.db.View(func(txn *badger.Txn) (err error) {
+		f, err = getFileMeta(txn, id)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	path, err := srv.dataFile(f)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, srv.Config.ScanTimeout)
+	res, err := srv.scanner.Scan(ctx, in)
+	cancel()
+	in.Close()
+	if err != nil {
+		return err
+	}
+	srv.Log.Debugw("File scanned", "id", id, "status", res.Status, "signature", res.Signature)
+	err = srv.update(func(txn *badger.Txn) error {
+		f, err := getFileMeta(txn, id)
+		if err != nil {
+			return err
+		}
+		f.Scan = res
+		return setFileMeta(txn, f)
+	})
+	if err != nil {
+		return err
+	}
+	err = srv.pubsub.Publish(context.Background(), "user."+f.Token, UserEvent{Type: "scan", FileID: id, State: res.Status})
+	if err != nil {
+		srv.Log.Warnw("Scan publish error", "id", id, "error", err)
+	}
+	if res.Status == ScanClean {
+		return srv.FileStateChange(id, StateSaved, "scanned")
+	}
+	err = srv.quarantine(f, path)
+	if err != nil {
+		return err
+	}
+	return srv.FileStateChange(id, StateInfected, res.Signature)
+}
+
+// quarantine moves file content out of DataPath
+func (srv Service) quarantine(f *File, path string) error {
+	err := os.MkdirAll(srv.Config.QuarantinePath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(srv.Config.QuarantinePath, f.ID+".data")
+	if err = os.Rename(path, dst); err == nil {
+		return nil
+	}
+	// may be other volume
+	if err = copyFile(path, dst); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// fileIDs returns IDs of files matching filter
+func (srv Service) fileIDs(filter func(f *File) bool) (ids []string, err error) {
+	err = srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			f, err := getFileMeta(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if filter(f) {
+				ids = append(ids, f.ID)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// resumeScans scans files which were not scanned before restart.
+// Files are scanned one by one until ctx is done
+func (srv Service) resumeScans(ctx context.Context) {
+	ids, err := srv.fileIDs(func(f *File) bool { return f.State == StateScanning })
+	if err != nil {
+		srv.Log.Errorw("Scan queue load error", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		srv.processScan(ctx, id)
+	}
+}
+
+// processScan runs scanFile and sets error state on fail of the last handler attempt
+func (srv Service) processScan(ctx context.Context, id string) error {
+	err := srv.scanFile(ctx, id)
+	if err == nil || !pubsub.LastAttempt(ctx) || ctx.Err() != nil {
+		return err
+	}
+	srv.Log.Errorw("File scan error", "id", id, "error", err)
+	if e := srv.FileStateChange(id, StateError, "scan: "+err.Error()); e != nil {
+		srv.Log.Errorw("File scan state error", "id", id, "error", e)
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// legacyLayout is the layout of files stored without Layout field
+const legacyLayout = "prefix:2:3"
+
+// keyShard holds layout of files after last reshard
+var keyShard = []byte("meta.shard")
+
+// Sharder places files into DataPath subdirs
+type Sharder interface {
+	// Dirs returns subdirs of file
+	Dirs(f *File) []string
+	// String returns layout spec, stored in File.Layout
+	String() string
+}
+
+// NewSharder returns sharder for layout spec like "hash:2:2"
+func NewSharder(spec string) (Sharder, error) {
+	parts := strings.Split(spec, ":")
+	nums := make([]int, len(parts)-1)
+	for i, p := range parts[1:] {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad layout %q: %s must be positive number", spec, p)
+		}
+		nums[i] = n
+	}
+	switch {
+	case parts[0] == "prefix" && len(nums) == 2:
+		return PrefixSharder{nums[0], nums[1]}, nil
+	case parts[0] == "hash" && len(nums) == 2:
+		return HashSharder{nums[0], nums[1]}, nil
+	case parts[0] == "date" && len(nums) == 1 && nums[0] <= 3:
+		return DateSharder{nums[0]}, nil
+	}
+	return nil, fmt.Errorf("unknown layout: %s", spec)
+}
+
+// layoutSpec returns layout spec for config
+func layoutSpec(cfg Config) string {
+	if cfg.Shard == "date" {
+		return fmt.Sprintf("date:%d", cfg.ShardDepth)
+	}
+	return fmt.Sprintf("%s:%d:%d", cfg.Shard, cfg.ShardDepth, cfg.ShardWidth)
+}
+
+// PrefixSharder uses ID prefix: 0000123 -> 000/012 (Depth 2, Width 3)
+type PrefixSharder struct {
+	Depth int
+	Width int
+}
+
+func (s PrefixSharder) Dirs(f *File) []string {
+	return splitDirs(f.ID, s.Depth, s.Width)
+}
+
+func (s PrefixSharder) String() string {
+	return fmt.Sprintf("prefix:%d:%d", s.Depth, s.Width)
+}
+
+// HashSharder uses prefix of ID sha1: 0000123 -> 3e/f1 (Depth 2, Width 2)
+type HashSharder struct {
+	Depth int
+	Width int
+}
+
+func (s HashSharder) Dirs(f *File) []string {
+	sum := sha1.Sum([]byte(f.ID))
+	return splitDirs(hex.EncodeToString(sum[:]), s.Depth, s.Width)
+}
+
+func (s HashSharder) String() string {
+	return fmt.Sprintf("hash:%d:%d", s.Depth, s.Width)
+}
+
+// DateSharder uses file creation date: 2020/02/16 (Depth 3)
+type DateSharder struct {
+	Depth int
+}
+
+func (s DateSharder) Dirs(f *File) []string {
+	return strings.Split(f.CreatedAt.UTC().Format("2006/01/02"), "/")[:s.Depth]
+}
+
+func (s DateSharder) String() string {
+	return fmt.Sprintf("date:%d", s.Depth)
+}
+
+// splitDirs returns depth parts of width chars from key start.
+// Short keys are padded with "_"
+func splitDirs(key string, depth, width int) []string {
+	if len(key) < depth*width {
+		key += strings.Repeat("_", depth*width-len(key))
+	}
+	dirs := make([]string, depth)
+	for i := range dirs {
+		dirs[i] = key[i*width : (i+1)*width]
+	}
+	return dirs
+}
+
+// fileLayout returns sharder of stored file
+func (srv Service) fileLayout(f *File) (Sharder, error) {
+	switch f.Layout {
+	case srv.sharder.String():
+		return srv.sharder, nil
+	case "":
+		return NewSharder(legacyLayout)
+	}
+	return NewSharder(f.Layout)
+}
+
+// shardPath returns file dir for given sharder
+func (srv Service) shardPath(s Sharder, f *File) string {
+	return filepath.Join(append([]string{srv.Config.DataPath}, s.Dirs(f)...)...)
+}
+
+// Reshard moves files to current layout and returns count of moved files
+func (srv Service) Reshard() (int, error) {
+	var files []*File
+	layout := srv.sharder.String()
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			f, err := getFileMeta(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if f.Layout != layout {
+				files = append(files, f)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, f := range files {
+		src, err := srv.dataFile(f)
+		if err != nil {
+			return moved, err
+		}
+		dstDir := srv.shardPath(srv.sharder, f)
+		dst := filepath.Join(dstDir, f.ID+".data")
+		// link, update metadata, unlink - file is reachable if process is killed at any step
+		if err = os.MkdirAll(dstDir, os.ModePerm); err != nil {
+			return moved, err
+		}
+		if err = os.Link(src, dst); err != nil && !os.IsExist(err) {
+			if !os.IsNotExist(err) {
+				return moved, err
+			}
+			srv.Log.Warnw("File content not found", "id", f.ID, "path", src)
+		}
+		err = srv.update(func(txn *badger.Txn) error {
+			f, err := getFileMeta(txn, f.ID)
+			if err != nil {
+				return err
+			}
+			f.Layout = layout
+			return setFileMeta(txn, f)
+		})
+		if err != nil {
+			return moved, err
+		}
+		if src != dst {
+			os.Remove(src)
+			removeEmptyDirs(filepath.Dir(src), srv.Config.DataPath)
+		}
+		moved++
+	}
+	err = srv.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(keyShard, []byte(layout))
+	})
+	return moved, err
+}
+
+// removeEmptyDirs removes dir and its empty parents up to root
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// checkLayout warns if stored files may use another layout
+func (srv Service) checkLayout() error {
+	return srv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(keyShard)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if string(val) != srv.sharder.String() {
+				srv.Log.Warnw("Files layout changed, run reshard to move files", "stored", string(val), "current", srv.sharder.String())
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	// HealthOK is the status of healthy storage
+	HealthOK = "ok"
+	// HealthDegraded is the status of storage with low free space
+	HealthDegraded = "degraded"
+	// AdminTopic receives storage warnings
+	AdminTopic = "admin"
+)
+
+// ErrInsufficientStorage returned when file does not fit into free space
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// Volume holds free space of storage path
+type Volume struct {
+	Path    string `json:"path"`
+	Free    int64  `json:"free"`
+	MinFree int64  `json:"min_free"`
+}
+
+// Health holds storage health status
+type Health struct {
+	Status  string   `json:"status"`
+	Volumes []Volume `json:"volumes"`
+}
+
+// AdminEvent published in AdminTopic
+type AdminEvent struct {
+	Type    string `json:"type"`
+	State   string `json:"state"`
+	Path    string `json:"path,omitempty"`
+	Free    int64  `json:"free"`
+	MinFree int64  `json:"min_free"`
+}
+
+// Health returns free space of DataPath and CachePath
+func (srv Service) Health() Health {
+	rv := Health{Status: HealthOK}
+	if err := srv.checkSpace(0); err != nil {
+		rv.Status = HealthDegraded
+	}
+	rv.Volumes = srv.volumes()
+	return rv
+}
+
+// volumes returns free space of storage paths. Free is -1 if unknown
+func (srv Service) volumes() []Volume {
+	minFree := srv.Config.MinFree << 20
+	var rv []Volume
+	for _, path := range []string{srv.Config.DataPath, srv.Config.CachePath} {
+		free, err := freeSpace(path)
+		if err != nil {
+			srv.Log.Warnw("Free space check error", "path", path, "error", err)
+			free = -1
+		}
+		rv = append(rv, Volume{Path: path, Free: free, MinFree: minFree})
+	}
+	return rv
+}
+
+// checkSpace returns ErrInsufficientStorage if free space after saving size bytes
+// becomes lower than MinFree. State changes are published to AdminTopic
+func (srv Service) checkSpace(size int64) error {
+	var low *Volume
+	for _, v := range srv.volumes() {
+		if v.Free >= 0 && v.Free-size < v.MinFree {
+			low = &v
+			break
+		}
+	}
+	if low == nil {
+		if srv.spaceLow.CompareAndSwap(true, false) {
+			srv.Log.Infow("Free space restored")
+			srv.publishAdmin(AdminEvent{Type: "space", State: HealthOK})
+		}
+		return nil
+	}
+	// upload may not fit while volume is still healthy
+	if low.Free < low.MinFree && srv.spaceLow.CompareAndSwap(false, true) {
+		srv.Log.Warnw("Free space is low", "path", low.Path, "free", low.Free, "min", low.MinFree)
+		srv.publishAdmin(AdminEvent{Type: "space", State: HealthDegraded, Path: low.Path, Free: low.Free, MinFree: low.MinFree})
+	}
+	return fmt.Errorf("%w: %s has %d bytes free", ErrInsufficientStorage, low.Path, low.Free)
+}
+
+func (srv Service) publishAdmin(ev AdminEvent) {
+	if err := srv.pubsub.Publish(context.Background(), AdminTopic, ev); err != nil {
+		srv.Log.Errorw("Admin event publish error", "error", err)
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// State is the file lifecycle state
+type State string
+
+const (
+	// StateReceived - file metadata saved, content is being written
+	StateReceived State = "received"
+	// StateSaved - file content saved and may be downloaded
+	StateSaved State = "saved"
+	// StateError - file content was not saved
+	StateError State = "error"
+	// StateScanning - file content saved and is being scanned for viruses
+	StateScanning State = "scanning"
+	// StateInfected - virus found, file content moved to quarantine
+	StateInfected State = "infected"
+)
+
+// transitions holds allowed state changes
+var transitions = map[State][]State{
+	StateReceived: {StateSaved, StateScanning, StateError},
+	StateScanning: {StateSaved, StateInfected, StateError},
+}
+
+// ErrTransition returned when state change is not allowed
+var ErrTransition = errors.New("illegal state transition")
+
+// TransitionError holds illegal state change
+type TransitionError struct {
+	ID   string
+	From State
+	To   State
+}
+
+func (e TransitionError) Error() string {
+	return fmt.Sprintf("file %s: %s -> %s: %s", e.ID, e.From, e.To, ErrTransition)
+}
+
+func (e TransitionError) Unwrap() error {
+	return ErrTransition
+}
+
+// CanTransit returns true if state change is allowed
+func CanTransit(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateChange holds file history item
+type StateChange struct {
+	State  State     `json:"state"`
+	From   State     `json:"from,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// FileStateChange changes file state, saves it in history and publishes UserEvent
+func (srv Service) FileStateChange(id string, state State, reason string) error {
+	var token string
+	err := srv.update(func(txn *badger.Txn) error {
+		f, err := getFileMeta(txn, id)
+		if err != nil {
+			return err
+		}
+		if !CanTransit(f.State, state) {
+			return TransitionError{id, f.State, state}
+		}
+		ch := StateChange{State: state, From: f.State, Reason: reason, At: time.Now()}
+		f.State = state
+		token = f.Token
+		err = setFileMeta(txn, f)
+		if err != nil {
+			return err
+		}
+		return addHistory(txn, id, ch)
+	})
+	if err != nil {
+		return err
+	}
+	//	srv.Log.Debugw("Raise event", "data", fmt.Sprintf("%+v", ev))
+	ev := UserEvent{Type: "file", FileID: id, State: string(state)}
+	err = srv.pubsub.Publish(context.Background(), "user."+token, ev)
+	if err != nil {
+		return err
+	}
+	err = srv.pubsub.Publish(context.Background(), "file", ev)
+	return err
+}
+
+// FileHistory returns state changes of token's file
+func (srv Service) FileHistory(token, id string) (history []StateChange, err error) {
+	if _, _, err = srv.File(token, id); err != nil {
+		return
+	}
+	err = srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := historyPrefix(id)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var ch StateChange
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ch)
+			})
+			if err != nil {
+				return err
+			}
+			history = append(history, ch)
+		}
+		return nil
+	})
+	return
+}
+
+func historyPrefix(id string) []byte {
+	return []byte("history." + id + ".")
+}
+
+// addHistory appends item to file history
+func addHistory(txn *badger.Txn, id string, ch StateChange) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	prefix := historyPrefix(id)
+	count := 0
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		count++
+	}
+	it.Close()
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(fmt.Sprintf("%s%06d", prefix, count)), data)
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package storage
+
+// freeSpace returns bytes available for unprivileged user on volume of path
+func freeSpace(path string) (int64, error) {
+	avail, size, err := statfs(path)
+	if err != nil {
+		return 0, err
+	}
+	return int64(avail) * int64(size), nil
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"syscall"
+)
+
+// statfs returns available blocks and block size of volume
+func statfs(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.F_bavail), uint64(st.F_bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package storage
+
+// freeSpace returns -1 as free space is unknown
+func freeSpace(path string) (int64, error) {
+	return -1, nil
+}
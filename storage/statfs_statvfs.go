@@ -0,0 +1,16 @@
+//go:build netbsd || solaris || illumos
+
+package storage
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// statfs returns available blocks and fragment size of volume
+func statfs(path string) (uint64, uint64, error) {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail), uint64(st.Frsize), nil
+}
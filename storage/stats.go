@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"encoding/json"
+	"expvar"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/google/uuid"
+)
+
+// Stats holds storage usage counters
+type Stats struct {
+	Files     int64            `json:"files"`
+	Bytes     int64            `json:"bytes"`
+	DiskBytes int64            `json:"disk_bytes"`
+	States    map[string]int64 `json:"states"`
+	Types     map[string]int64 `json:"types"`
+}
+
+// DBSize holds badger files size
+type DBSize struct {
+	LSM  int64 `json:"lsm"`
+	Vlog int64 `json:"vlog"`
+}
+
+const (
+	// statsPrefix is the prefix of stats keys
+	statsPrefix = "stats."
+	// statsAll is the key of global stats
+	statsAll = statsPrefix + "all"
+	// statsUser is the prefix of user stats keys
+	statsUser = statsPrefix + "user."
+	// statsDelta is the prefix of stats changes which are not folded into stats keys yet
+	statsDelta = statsPrefix + "delta."
+	// foldBatch is the max number of deltas folded in one txn
+	foldBatch = 1000
+	// updateRetries is the number of update attempts on txn conflict
+	updateRetries = 10
+	// updateBackoff is the max delay before first update retry, doubled on each retry
+	updateBackoff = 5 * time.Millisecond
+)
+
+var (
+	// expvarOnce guards expvar publishing
+	expvarOnce sync.Once
+	// expvarStore holds service published via expvar
+	expvarStore struct {
+		sync.RWMutex
+		srv *Service
+	}
+)
+
+func newStats() *Stats {
+	return &Stats{States: map[string]int64{}, Types: map[string]int64{}}
+}
+
+// add counts file in stats with sign 1 (add) or -1 (remove)
+func (s *Stats) add(f *File, sign int64) {
+	s.Files += sign
+	s.Bytes += sign * f.Size
+	s.DiskBytes += sign * f.DiskSize
+	incr(s.States, string(f.State), sign)
+	incr(s.Types, f.CType, sign)
+}
+
+func incr(m map[string]int64, key string, delta int64) {
+	m[key] += delta
+	if m[key] == 0 {
+		delete(m, key)
+	}
+}
+
+func getStats(txn *badger.Txn, key string) (*Stats, error) {
+	s := newStats()
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, s)
+	})
+	return s, err
+}
+
+func setStats(txn *badger.Txn, key string, s *Stats) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(key), data)
+}
+
+// updateStats saves change of global and user stats as delta key with unique name,
+// so concurrent file updates do not conflict on stats keys. Deltas are folded by foldStats
+func updateStats(txn *badger.Txn, old, f *File) error {
+	delta := map[string]*Stats{}
+	change := func(key string, f *File, sign int64) {
+		s, ok := delta[key]
+		if !ok {
+			s = newStats()
+			delta[key] = s
+		}
+		s.add(f, sign)
+	}
+	if old != nil {
+		change(statsAll, old, -1)
+		change(statsUser+old.Token, old, -1)
+	}
+	change(statsAll, f, 1)
+	change(statsUser+f.Token, f, 1)
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(statsDelta+uuid.NewString()), data)
+}
+
+// merge adds delta counters to stats
+func (s *Stats) merge(delta *Stats) {
+	s.Files += delta.Files
+	s.Bytes += delta.Bytes
+	s.DiskBytes += delta.DiskBytes
+	for k, v := range delta.States {
+		incr(s.States, k, v)
+	}
+	for k, v := range delta.Types {
+		incr(s.Types, k, v)
+	}
+}
+
+// foldStats adds saved deltas to stats keys and removes them
+func (srv Service) foldStats() error {
+	srv.statsMu.Lock()
+	defer srv.statsMu.Unlock()
+	for {
+		n := 0
+		err := srv.update(func(txn *badger.Txn) error {
+			n = 0
+			stats := map[string]*Stats{}
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			prefix := []byte(statsDelta)
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && n < foldBatch; it.Next() {
+				var delta map[string]*Stats
+				err := it.Item().Value(func(val []byte) error {
+					return json.Unmarshal(val, &delta)
+				})
+				if err != nil {
+					return err
+				}
+				for key, d := range delta {
+					s, ok := stats[key]
+					if !ok {
+						if s, err = getStats(txn, key); err != nil {
+							return err
+						}
+						stats[key] = s
+					}
+					s.merge(d)
+				}
+				if err = txn.Delete(it.Item().KeyCopy(nil)); err != nil {
+					return err
+				}
+				n++
+			}
+			for key, s := range stats {
+				if err := setStats(txn, key, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < foldBatch {
+			return err
+		}
+	}
+}
+
+// update runs db.Update and retries it with jittered backoff on conflicts with concurrent updates
+func (srv Service) update(fn func(txn *badger.Txn) error) (err error) {
+	delay := updateBackoff
+	for i := 0; i < updateRetries; i++ {
+		err = srv.db.Update(fn)
+		if err != badger.ErrConflict {
+			return
+		}
+		time.Sleep(rand.N(delay) + 1)
+		delay *= 2
+	}
+	return
+}
+
+// Stats returns global stats
+func (srv Service) Stats() (s *Stats, err error) {
+	if err = srv.foldStats(); err != nil {
+		return
+	}
+	err = srv.db.View(func(txn *badger.Txn) error {
+		s, err = getStats(txn, statsAll)
+		return err
+	})
+	return
+}
+
+// UserStats returns stats of user files
+func (srv Service) UserStats(token string) (s *Stats, err error) {
+	if err = srv.foldStats(); err != nil {
+		return
+	}
+	err = srv.db.View(func(txn *badger.Txn) error {
+		s, err = getStats(txn, statsUser+token)
+		return err
+	})
+	return
+}
+
+// UsersStats returns stats of all users
+func (srv Service) UsersStats() (map[string]*Stats, error) {
+	if err := srv.foldStats(); err != nil {
+		return nil, err
+	}
+	rv := map[string]*Stats{}
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(statsUser)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			s := newStats()
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, s)
+			})
+			if err != nil {
+				return err
+			}
+			rv[string(it.Item().Key()[len(prefix):])] = s
+		}
+		return nil
+	})
+	return rv, err
+}
+
+// DBSize returns size of badger LSM tree and value log
+func (srv Service) DBSize() DBSize {
+	lsm, vlog := srv.db.Size()
+	return DBSize{lsm, vlog}
+}
+
+// publishExpvar shows stats of last opened service in /debug/vars
+func (srv Service) publishExpvar() {
+	expvarStore.Lock()
+	expvarStore.srv = &srv
+	expvarStore.Unlock()
+	expvarOnce.Do(func() {
+		expvar.Publish("storage", expvar.Func(func() interface{} {
+			expvarStore.RLock()
+			defer expvarStore.RUnlock()
+			srv := expvarStore.srv
+			if srv == nil {
+				return nil
+			}
+			stats, err := srv.Stats()
+			if err != nil {
+				return err.Error()
+			}
+			return map[string]interface{}{"db": srv.DBSize(), "stats": stats}
+		}))
+	})
+}
+
+// unpublishExpvar removes closed service from /debug/vars
+func (srv Service) unpublishExpvar() {
+	expvarStore.Lock()
+	if expvarStore.srv != nil && expvarStore.srv.db == srv.db {
+		expvarStore.srv = nil
+	}
+	expvarStore.Unlock()
+}
+
+// rebuildStats counts stats of all files and removes unfolded deltas
+func rebuildStats(srv Service) error {
+	srv.statsMu.Lock()
+	defer srv.statsMu.Unlock()
+	all := newStats()
+	var deltas [][]byte
+	users := map[string]*Stats{}
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			f, err := getFileMeta(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			all.add(f, 1)
+			s, ok := users[f.Token]
+			if !ok {
+				s = newStats()
+				users[f.Token] = s
+			}
+			s.add(f, 1)
+		}
+		prefix = []byte(statsDelta)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			deltas = append(deltas, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	keys := map[string]*Stats{statsAll: all}
+	for token, s := range users {
+		keys[statsUser+token] = s
+	}
+	wb := srv.db.NewWriteBatch()
+	defer wb.Cancel()
+	for key, s := range keys {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if err = wb.Set([]byte(key), data); err != nil {
+			return err
+		}
+	}
+	for _, key := range deltas {
+		if err = wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
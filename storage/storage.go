@@ -2,14 +2,13 @@
 package storage
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
-	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -22,21 +21,36 @@ import (
 
 // Config holds all config vars
 type Config struct {
-	DataPath  string `long:"data" default:"var/data" description:"Path to served files"`
-	CachePath string `long:"cache" default:"var/cache" description:"Path to cache files"`
+	DataPath       string        `long:"data" default:"var/data" description:"Path to served files"`
+	CachePath      string        `long:"cache" default:"var/cache" description:"Path to cache files"`
+	ImportMaxSize  int64         `long:"import_max" default:"100" description:"Imported file size limit, Mb"`
+	ImportTimeout  time.Duration `long:"import_timeout" default:"5m" description:"Imported file download timeout"`
+	ImportHosts    []string      `long:"import_host" description:"Host allowed for import (may be given several times)"`
+	ScanAddr       string        `long:"clamd" description:"clamd address (tcp://host:3310 or unix:///path/clamd.sock), no scan if empty"`
+	ScanTimeout    time.Duration `long:"clamd_timeout" default:"1m" description:"File scan timeout"`
+	QuarantinePath string        `long:"quarantine" default:"var/quarantine" description:"Path to infected files"`
+	MinFree        int64         `long:"min_free" default:"100" description:"Free space on data & cache volumes required for upload, Mb"`
+	IDScheme       string        `long:"id" default:"seq" choice:"seq" choice:"ulid" choice:"rand" description:"New file ID generator"`
+	Shard          string        `long:"shard" default:"prefix" choice:"prefix" choice:"hash" choice:"date" description:"New files dirs layout"`
+	ShardDepth     int           `long:"shard_depth" default:"2" description:"Layout dirs depth (date: 1 - year, 2 - month, 3 - day)"`
+	ShardWidth     int           `long:"shard_width" default:"3" description:"Layout dir name length (prefix & hash)"`
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
 
 type File struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Size      int64     `json:"size"`
-	CType     string    `json:"type"`
-	Token     string    `json:"token"`
-	State     string    `json:"state"`
-	SHA1      string    `json:"sha1"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Size      int64       `json:"size"`
+	CType     string      `json:"type"`
+	Token     string      `json:"token"`
+	State     State       `json:"state"`
+	SHA1      string      `json:"sha1"`
+	CreatedAt time.Time   `json:"created_at"`
+	Layout    string      `json:"layout,omitempty"`
+	Scan      *ScanResult `json:"scan,omitempty"`
+	DiskSize  int64       `json:"disk_size"`
+	Meta      *Meta       `json:"meta,omitempty"`
 }
 
 const (
@@ -44,19 +58,34 @@ const (
 	ErrNoSingleFile = "field 'file' does not contains single item"
 )
 
+const (
+	// tmpSuffix added to file name while its content is written
+	tmpSuffix = ".tmp"
+)
+
 var (
+	// ErrNotOwner returned when file is owned by another token
+	ErrNotOwner = errors.New("Owner not matched")
+
 	seqFileID = []byte("fileID")
 )
 
 // Service holds upload service
 type Service struct {
-	Config *Config
-	Log    *log.SugaredLogger
-	db     *badger.DB
-	ticker *time.Ticker
-	quit   chan struct{}
-	quitGC chan struct{}
-	pubsub *pubsub.Service
+	Config  *Config
+	Log     *log.SugaredLogger
+	db      *badger.DB
+	ids     IDGenerator
+	sharder Sharder
+	scanner Scanner
+	// spaceLow is true when free space is lower than Config.MinFree
+	spaceLow *atomic.Bool
+	// statsMu serializes stats folding
+	statsMu *sync.Mutex
+	ticker  *time.Ticker
+	quit    chan struct{}
+	quitGC  chan struct{}
+	pubsub  *pubsub.Service
 }
 
 // New creates an Service object
@@ -65,23 +94,65 @@ func New(cfg Config, logger *log.SugaredLogger, ps *pubsub.Service) (*Service, e
 	if err != nil {
 		return nil, err
 	}
+	ids, err := newIDGenerator(cfg.IDScheme, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sharder, err := NewSharder(layoutSpec(cfg))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var scanner Scanner
+	if cfg.ScanAddr != "" {
+		scanner, err = NewClamd(cfg.ScanAddr)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 
 	srv := &Service{
-		Config: &cfg,
-		Log:    logger,
-		db:     db,
-		ticker: time.NewTicker(5 * time.Minute),
-		quit:   make(chan struct{}),
-		quitGC: make(chan struct{}),
-		pubsub: ps,
+		Config:   &cfg,
+		Log:      logger,
+		db:       db,
+		ids:      ids,
+		sharder:  sharder,
+		scanner:  scanner,
+		spaceLow: &atomic.Bool{},
+		statsMu:  &sync.Mutex{},
+		ticker:   time.NewTicker(5 * time.Minute),
+		quit:     make(chan struct{}),
+		quitGC:   make(chan struct{}),
+		pubsub:   ps,
+	}
+	err = srv.migrate()
+	if err == nil {
+		err = srv.checkLayout()
+	}
+	if err == nil {
+		err = srv.recoverFiles()
 	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	srv.publishExpvar()
 	go srv.gc()
 	return srv, nil
 }
 
 func (srv Service) Close() {
+	srv.unpublishExpvar()
 	close(srv.quitGC)
 	srv.ticker.Stop()
+	if c, ok := srv.ids.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			srv.Log.Warnw("ID generator close error", "error", err)
+		}
+	}
 	srv.db.Close()
 }
 
@@ -89,6 +160,10 @@ func (srv Service) gc() {
 	for {
 		select {
 		case <-srv.ticker.C:
+			srv.checkSpace(0)
+			if err := srv.foldStats(); err != nil {
+				srv.Log.Warnw("Stats fold error", "error", err)
+			}
 			srv.Log.Debug("GC run")
 			err := srv.db.RunValueLogGC(0.7)
 			if err != nil && err != badger.ErrNoRewrite { // TODO && !db.close - "error": "Value log GC attempt didn't result in any cleanup"
@@ -102,67 +177,103 @@ func (srv Service) gc() {
 	}
 }
 
-func (srv Service) filePath(id string) string {
-	return filepath.Join(srv.Config.DataPath, id[0:3], id[3:6]) // TODO: sharding
-}
-
-func (srv Service) AddFile(token string, file *multipart.FileHeader) (key string, err error) {
-	seq, err := srv.db.GetSequence(seqFileID, 1)
-	if err != nil {
-		return "", err
-	}
-	defer seq.Release()
-	num, err := seq.Next()
+// filePath returns dir of file content
+func (srv Service) filePath(f *File) (string, error) {
+	s, err := srv.fileLayout(f)
 	if err != nil {
 		return "", err
 	}
-	id := fmt.Sprintf("%07d", num)
-	srv.Log.Debugw("Store file", "id", id, "name", file.Filename, "size", file.Size, "ctype", file.Header["Content-Type"])
-	dstDir := srv.filePath(id)
-	os.MkdirAll(dstDir, os.ModePerm)
-	dst := filepath.Join(dstDir, id+".data")
+	return srv.shardPath(s, f), nil
+}
 
+// dataFile returns path to file content
+func (srv Service) dataFile(f *File) (string, error) {
+	dir, err := srv.filePath(f)
 	if err != nil {
 		return "", err
 	}
+	return filepath.Join(dir, f.ID+".data"), nil
+}
+
+func (srv Service) AddFile(token string, file *multipart.FileHeader) (key string, err error) {
 	var ctype string
 	if len(file.Header["Content-Type"]) > 0 {
 		ctype = file.Header["Content-Type"][0]
 	}
 	f := File{
-		ID:        id,
-		Name:      file.Filename,
-		Size:      file.Size,
-		CType:     ctype,
-		Token:     token,
-		State:     "received",
-		CreatedAt: time.Now(),
-	}
-	err = srv.db.Update(func(txn *badger.Txn) error {
-		err := setFileMeta(txn, &f)
-		if err == nil {
-			err = txn.Set([]byte("user."+token+"."+id), []byte("1"))
-		}
-		return err
-	})
+		Name:  file.Filename,
+		Size:  file.Size,
+		CType: ctype,
+		Token: token,
+		State: StateReceived,
+	}
+	dst, err := srv.addFile(&f, "upload")
+	if err != nil {
+		return "", err
+	}
+	id := f.ID
+	srv.Log.Debugw("Store file", "id", id, "name", file.Filename, "size", file.Size, "ctype", ctype)
 	go func() {
 		err := srv.saveUploadedFile(file, dst, token, id)
 		if err != nil {
-			srv.Log.Errorw("File save error", "token", token, "file", id, "error", err)
-			err = srv.pubsub.Publish("user."+token, UserEvent{"file", id, "error"})
-			if err != nil {
-				srv.Log.Errorw("File save publish error", "token", token, "file", id, "error", err)
-			}
+			srv.fileFailed(&f, err)
 		}
 	}()
 	return id, nil
 
 }
 
+// addFile assigns ID to new file, saves its metadata and returns path for file content
+func (srv Service) addFile(f *File, reason string) (string, error) {
+	if err := srv.checkSpace(f.Size); err != nil {
+		return "", err
+	}
+	id, err := srv.ids.NewID()
+	if err != nil {
+		return "", err
+	}
+	f.ID = id
+	f.CreatedAt = time.Now()
+	f.Layout = srv.sharder.String()
+	dst, err := srv.dataFile(f)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	err = srv.update(func(txn *badger.Txn) error {
+		err := setFileMeta(txn, f)
+		if err == nil {
+			err = txn.Set([]byte("user."+f.Token+"."+id), []byte("1"))
+		}
+		if err == nil {
+			err = addHistory(txn, id, StateChange{State: f.State, Reason: reason, At: f.CreatedAt})
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// fileFailed logs file processing error and sets file state
+func (srv Service) fileFailed(f *File, err error) {
+	srv.Log.Errorw("File save error", "token", f.Token, "file", f.ID, "error", err)
+	err = srv.FileStateChange(f.ID, StateError, err.Error())
+	if err != nil {
+		srv.Log.Errorw("File save state error", "token", f.Token, "file", f.ID, "error", err)
+	}
+}
+
 type UserEvent struct {
 	Type   string `json:"type"`
 	FileID string `json:"id"`
 	State  string `json:"state"`
+	// Size holds bytes received by import
+	Size int64 `json:"size,omitempty"`
 }
 
 // SaveUploadedFile is a copy of gin.Context.SaveUploadedFile without context dep
@@ -173,43 +284,116 @@ func (srv Service) saveUploadedFile(file *multipart.FileHeader, dst, token, id s
 	}
 	defer src.Close()
 
-	out, err := os.Create(dst)
+	err = writeFileAtomic(dst, src, func() {
+		time.Sleep(2 * time.Second) // эмуляция записи большого файла
+	})
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, src)
+	err = srv.setDiskSize(id, dst)
 	if err != nil {
 		return err
 	}
-	time.Sleep(2 * time.Second) // эмуляция записи большого файла
-	err = srv.FileStateChange(id, "saved")
+	err = srv.FileStateChange(id, srv.savedState(), "upload saved")
 
 	return err
 }
 
-func (srv Service) FileStateChange(id, state string) error {
-	var token string
-	err := srv.db.Update(func(txn *badger.Txn) error {
+// setDiskSize saves disk usage of file content
+func (srv Service) setDiskSize(id, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return srv.update(func(txn *badger.Txn) error {
 		f, err := getFileMeta(txn, id)
 		if err != nil {
 			return err
 		}
-		f.State = state
-		token = f.Token
+		f.DiskSize = diskUsage(fi)
 		return setFileMeta(txn, f)
 	})
+}
+
+// writeFileAtomic copies src into temp file near dst, syncs it and renames to dst.
+// So dst is either absent or complete. Optional hook is called before rename
+func writeFileAtomic(dst string, src io.Reader, hook func()) error {
+	tmp := dst + tmpSuffix
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil && hook != nil {
+		hook()
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	//	srv.Log.Debugw("Raise event", "data", fmt.Sprintf("%+v", ev))
-	err = srv.pubsub.Publish("user."+token, UserEvent{"file", id, state})
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes directory entry changes (file rename) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
-	err = srv.pubsub.Publish("file", UserEvent{"file", id, state})
-	return err
+	defer d.Close()
+	return d.Sync()
+}
+
+// recoverFiles fixes files which were left in "received" state by previous run.
+// If file content was renamed to its final name, it is complete and file becomes "saved",
+// otherwise partial data is removed and file becomes "error"
+func (srv Service) recoverFiles() error {
+	var files []*File
+	err := srv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("file.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			f, err := getFileMeta(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if f.State == StateReceived {
+				files = append(files, f)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		state, reason := srv.savedState(), "saved before restart"
+		dst, err := srv.dataFile(f)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(dst); err != nil {
+			state, reason = StateError, "not saved before restart"
+			os.Remove(dst + tmpSuffix)
+		} else if err = srv.setDiskSize(f.ID, dst); err != nil {
+			return err
+		}
+		srv.Log.Warnw("Recover stuck file", "id", f.ID, "state", state)
+		if err := srv.FileStateChange(f.ID, state, reason); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (srv Service) FileList(token string) (files []File, err error) {
@@ -250,43 +434,10 @@ func (srv Service) File(token, id string) (fileMeta *File, filePath string, err
 		return
 	}
 	if fileMeta.Token != token {
-		err = errors.New("Owner not matched")
+		err = ErrNotOwner
 		return
 	}
 
-	filePath = filepath.Join(srv.filePath(id), id+".data")
+	filePath, err = srv.dataFile(fileMeta)
 	return
 }
-
-func getFileMeta(txn *badger.Txn, id string) (*File, error) {
-	val, err := txn.Get([]byte("file." + id))
-	if err != nil {
-		return nil, err
-	}
-	var valCopy []byte
-	err = val.Value(func(val []byte) error {
-		valCopy = append([]byte{}, val...)
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(valCopy)
-	dec := gob.NewDecoder(buf)
-	var f File
-	err = dec.Decode(&f)
-	if err != nil {
-		return nil, err
-	}
-	return &f, nil
-}
-
-func setFileMeta(txn *badger.Txn, f *File) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(f)
-	if err != nil {
-		return err
-	}
-	return txn.Set([]byte("file."+f.ID), buf.Bytes())
-}
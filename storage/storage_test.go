@@ -0,0 +1,890 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	log "go.uber.org/zap"
+
+	"github.com/LeKovr/sfs/pubsub"
+)
+
+func newTestService(t *testing.T, cfg Config) *Service {
+	if cfg.DataPath == "" {
+		cfg.DataPath = filepath.Join(t.TempDir(), "data")
+	}
+	if cfg.CachePath == "" {
+		cfg.CachePath = filepath.Join(t.TempDir(), "cache")
+	}
+	if cfg.Shard == "" {
+		cfg.Shard, cfg.ShardDepth, cfg.ShardWidth = "prefix", 2, 3
+	}
+	l := log.NewNop().Sugar()
+	ps, err := pubsub.New(pubsub.Config{}, l)
+	require.NoError(t, err)
+	go ps.Run()
+	srv, err := New(cfg, l, ps)
+	require.NoError(t, err)
+	return srv
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "0000001.data")
+	err := writeFileAtomic(dst, strings.NewReader("content"), func() {
+		_, err := os.Stat(dst)
+		assert.True(t, os.IsNotExist(err), "dst must not exist before rename")
+	})
+	require.NoError(t, err)
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	_, err = os.Stat(dst + tmpSuffix)
+	assert.True(t, os.IsNotExist(err), "tmp file must be removed")
+}
+
+func TestRecoverFiles(t *testing.T) {
+	srv := newTestService(t, Config{})
+	cfg := *srv.Config
+	files := []File{
+		{ID: "0000001", Token: "t", State: "received", CreatedAt: time.Now()},
+		{ID: "0000002", Token: "t", State: "received", CreatedAt: time.Now()},
+	}
+	err := srv.db.Update(func(txn *badger.Txn) error {
+		for i := range files {
+			if err := setFileMeta(txn, &files[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	// first file was renamed before crash, second one was not
+	saved := testDataFile(t, srv, &files[0])
+	partial := testDataFile(t, srv, &files[1]) + tmpSuffix
+	require.NoError(t, os.WriteFile(saved, []byte("data"), 0o644))
+	require.NoError(t, os.WriteFile(partial, []byte("da"), 0o644))
+	srv.Close()
+
+	srv = newTestService(t, cfg)
+	defer srv.Close()
+	want := map[string]State{"0000001": StateSaved, "0000002": StateError}
+	for id, state := range want {
+		var f *File
+		err = srv.db.View(func(txn *badger.Txn) (err error) {
+			f, err = getFileMeta(txn, id)
+			return
+		})
+		require.NoError(t, err)
+		assert.Equal(t, state, f.State, id)
+	}
+	_, err = os.Stat(partial)
+	assert.True(t, os.IsNotExist(err), "partial file must be removed")
+	// disk usage of recovered file is counted
+	all, err := srv.Stats()
+	require.NoError(t, err)
+	assert.Positive(t, all.DiskBytes)
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := newTestService(t, Config{})
+	defer src.Close()
+	f := File{ID: "0000001", Token: "t", State: "saved", CreatedAt: time.Now()}
+	require.NoError(t, src.db.Update(func(txn *badger.Txn) error {
+		if err := setFileMeta(txn, &f); err != nil {
+			return err
+		}
+		return txn.Set([]byte("user.t."+f.ID), []byte("1"))
+	}))
+	require.NoError(t, os.WriteFile(testDataFile(t, src, &f), []byte("data"), 0o644))
+
+	var buf bytes.Buffer
+	info, err := src.Backup(&buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Files)
+	assert.NotZero(t, info.Next)
+
+	dst := newTestService(t, Config{})
+	defer dst.Close()
+	_, err = dst.Restore(bytes.NewReader(buf.Bytes()), false)
+	require.NoError(t, err)
+	files, err := dst.FileList("t")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, StateSaved, files[0].State)
+	data, err := os.ReadFile(testDataFile(t, dst, &f))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	_, err = dst.Restore(bytes.NewReader(buf.Bytes()), false)
+	assert.ErrorIs(t, err, ErrStoreNotEmpty)
+	_, err = dst.Restore(bytes.NewReader(buf.Bytes()), true)
+	assert.NoError(t, err)
+
+	// nothing changed since full backup
+	buf.Reset()
+	incr, err := src.Backup(&buf, info.Next)
+	require.NoError(t, err)
+	assert.Equal(t, 0, incr.Files)
+}
+
+func TestBackupDataPath(t *testing.T) {
+	// dataFile returns clean path
+	src := newTestService(t, Config{DataPath: filepath.Join(t.TempDir(), "data") + "/./"})
+	defer src.Close()
+	f := File{ID: "0000001", Token: "t", State: "saved", CreatedAt: time.Now()}
+	require.NoError(t, src.db.Update(func(txn *badger.Txn) error {
+		return setFileMeta(txn, &f)
+	}))
+	require.NoError(t, os.WriteFile(testDataFile(t, src, &f), []byte("data"), 0o644))
+	var buf bytes.Buffer
+	_, err := src.Backup(&buf, 0)
+	require.NoError(t, err)
+
+	dst := newTestService(t, Config{})
+	defer dst.Close()
+	_, err = dst.Restore(bytes.NewReader(buf.Bytes()), false)
+	require.NoError(t, err)
+	data, err := os.ReadFile(testDataFile(t, dst, &f))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestMigrateGob(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	f := File{ID: "0000001", Name: "a.txt", Token: "t", State: "saved", CreatedAt: time.Now().UTC()}
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(f))
+	require.NoError(t, srv.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(keySchema); err != nil {
+			return err
+		}
+		return txn.Set([]byte("file."+f.ID), buf.Bytes())
+	}))
+	require.NoError(t, srv.migrate())
+
+	var raw []byte
+	require.NoError(t, srv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("file." + f.ID))
+		if err != nil {
+			return err
+		}
+		raw, err = item.ValueCopy(nil)
+		return err
+	}))
+	var rec record
+	require.NoError(t, json.Unmarshal(raw, &rec))
+	assert.Equal(t, metaVersion, rec.Version)
+	got, err := decodeFileMeta(raw)
+	require.NoError(t, err)
+	assert.Equal(t, f.Name, got.Name)
+	assert.True(t, f.CreatedAt.Equal(got.CreatedAt))
+
+	_, err = decodeFileMeta([]byte(`{"v":999,"file":{}}`))
+	assert.ErrorIs(t, err, ErrMetaVersion)
+}
+
+func TestIDGenerators(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	tests := []struct {
+		scheme string
+		size   int
+	}{
+		{"seq", 7},
+		{"ulid", 26},
+		{"rand", 16},
+	}
+	for _, tt := range tests {
+		gen, err := newIDGenerator(tt.scheme, srv.db)
+		require.NoError(t, err)
+		a, err := gen.NewID()
+		require.NoError(t, err)
+		b, err := gen.NewID()
+		require.NoError(t, err)
+		assert.Len(t, a, tt.size, tt.scheme)
+		assert.NotEqual(t, a, b, tt.scheme)
+	}
+	_, err := newIDGenerator("bad", srv.db)
+	assert.Error(t, err)
+}
+
+func TestSharders(t *testing.T) {
+	f := &File{ID: "0000123", CreatedAt: time.Date(2020, 2, 16, 10, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		spec string
+		file *File
+		dirs []string
+	}{
+		{"prefix:2:3", f, []string{"000", "012"}},
+		{"prefix:2:3", &File{ID: "ab"}, []string{"ab_", "___"}},
+		{"hash:2:2", f, []string{"3e", "f1"}},
+		{"date:2", f, []string{"2020", "02"}},
+	}
+	for _, tt := range tests {
+		s, err := NewSharder(tt.spec)
+		require.NoError(t, err)
+		assert.Equal(t, tt.spec, s.String())
+		if tt.spec == "hash:2:2" {
+			sum := sha1.Sum([]byte(tt.file.ID))
+			tt.dirs = []string{hex.EncodeToString(sum[:1]), hex.EncodeToString(sum[1:2])}
+		}
+		assert.Equal(t, tt.dirs, s.Dirs(tt.file), tt.spec)
+	}
+	for _, spec := range []string{"prefix:2", "hash:0:2", "date:4", "other:1:1"} {
+		_, err := NewSharder(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	srv := newTestService(t, Config{})
+	cfg := *srv.Config
+	f := File{ID: "0000001", Token: "t", State: "saved", CreatedAt: time.Now()}
+	require.NoError(t, srv.db.Update(func(txn *badger.Txn) error {
+		return setFileMeta(txn, &f)
+	}))
+	legacy := testDataFile(t, srv, &f)
+	assert.Equal(t, filepath.Join(cfg.DataPath, "000", "000", "0000001.data"), legacy)
+	require.NoError(t, os.WriteFile(legacy, []byte("data"), 0o644))
+	srv.Close()
+
+	cfg.Shard = "date"
+	cfg.ShardDepth = 1
+	srv = newTestService(t, cfg)
+	defer srv.Close()
+	// mixed layouts are resolved by file record
+	_, path, err := srv.File("t", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, legacy, path)
+
+	moved, err := srv.Reshard()
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	_, path, err = srv.File("t", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(cfg.DataPath, f.CreatedAt.UTC().Format("2006"), "0000001.data"), path)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	_, err = os.Stat(filepath.Join(cfg.DataPath, "000"))
+	assert.True(t, os.IsNotExist(err), "empty legacy dirs must be removed")
+}
+
+// testDataFile returns path to file content and creates its dir
+func testDataFile(t *testing.T, srv *Service, f *File) string {
+	path, err := srv.dataFile(f)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	return path
+}
+
+func TestStats(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	files := []File{
+		{ID: "0000001", Token: "a", Size: 10, CType: "text/plain", State: "received"},
+		{ID: "0000002", Token: "a", Size: 20, CType: "image/png", State: "received"},
+		{ID: "0000003", Token: "b", Size: 30, CType: "text/plain", State: "received"},
+	}
+	for i := range files {
+		require.NoError(t, srv.update(func(txn *badger.Txn) error {
+			return setFileMeta(txn, &files[i])
+		}))
+	}
+	require.NoError(t, srv.FileStateChange("0000001", StateSaved, "test"))
+
+	all, err := srv.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, &Stats{
+		Files:  3,
+		Bytes:  60,
+		States: map[string]int64{"received": 2, "saved": 1},
+		Types:  map[string]int64{"text/plain": 2, "image/png": 1},
+	}, all)
+	user, err := srv.UserStats("b")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), user.Files)
+	assert.Equal(t, int64(30), user.Bytes)
+
+	users, err := srv.UsersStats()
+	require.NoError(t, err)
+	require.NoError(t, rebuildStats(*srv))
+	rebuilt, err := srv.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, all, rebuilt)
+	rebuiltUsers, err := srv.UsersStats()
+	require.NoError(t, err)
+	assert.Equal(t, users, rebuiltUsers)
+}
+
+func TestConcurrentUpload(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	f := File{Name: "a.txt", Size: 4, Token: "a", State: "received"}
+	dst, err := srv.addFile(&f, "test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, []byte("data"), 0o644))
+	require.NoError(t, srv.FileStateChange(f.ID, StateSaved, "test"))
+
+	const n = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := srv.addFile(&File{Name: "b.txt", Size: 1, Token: "b", State: "received"}, "test")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := srv.CopyFile("a", f.ID, "c")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	all, err := srv.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*n+1), all.Files)
+	users, err := srv.UsersStats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(n), users["b"].Files)
+	assert.Equal(t, int64(4*n), users["c"].Bytes)
+}
+
+// waitState returns file state from first user event with state other than "received"
+func waitState(t *testing.T, messages <-chan pubsub.Message, id string) string {
+	for {
+		select {
+		case msg := <-messages:
+			var ev UserEvent
+			require.NoError(t, json.Unmarshal(msg.Payload, &ev))
+			if ev.Type == "file" && ev.FileID == id && ev.State != "received" {
+				return ev.State
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("file state timeout")
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Write(bytes.Repeat([]byte("x"), 2<<20))
+			return
+		}
+		if r.URL.Path == "/huge" {
+			// larger than any test volume
+			w.Header().Set("Content-Length", strconv.FormatInt(1<<55, 10))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("imported"))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	srv := newTestService(t, Config{ImportMaxSize: 1, ImportTimeout: time.Minute, ImportHosts: []string{u.Hostname()}})
+	defer srv.Close()
+	stream, err := srv.pubsub.Subscribe(context.Background(), "user.t")
+	require.NoError(t, err)
+	defer stream.Unsubscribe()
+
+	id, err := srv.ImportFile("t", ts.URL+"/dir/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "saved", waitState(t, stream.Messages, id))
+	f, path, err := srv.File("t", id)
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", f.Name)
+	assert.Equal(t, "text/plain", f.CType)
+	assert.Equal(t, int64(8), f.Size)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "imported", string(data))
+
+	id, err = srv.ImportFile("t", ts.URL+"/big")
+	require.NoError(t, err)
+	assert.Equal(t, "error", waitState(t, stream.Messages, id))
+
+	// declared size is checked against free space
+	srv.Config.ImportMaxSize = 1 << 40
+	id, err = srv.ImportFile("t", ts.URL+"/huge")
+	require.NoError(t, err)
+	assert.Equal(t, "error", waitState(t, stream.Messages, id))
+	history, err := srv.FileHistory("t", id)
+	require.NoError(t, err)
+	assert.Contains(t, history[len(history)-1].Reason, ErrInsufficientStorage.Error())
+
+	_, err = srv.ImportFile("t", "http://example.com/a.txt")
+	assert.ErrorIs(t, err, ErrImportHost)
+	_, err = srv.ImportFile("t", "file:///etc/passwd")
+	assert.ErrorIs(t, err, ErrImportURL)
+}
+
+func TestCopyFile(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	f := File{Name: "a.txt", Size: 4, Token: "a", State: "received"}
+	dst, err := srv.addFile(&f, "test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, []byte("data"), 0o644))
+
+	_, err = srv.CopyFile("a", f.ID, "b")
+	assert.ErrorIs(t, err, ErrNotSaved)
+	require.NoError(t, srv.FileStateChange(f.ID, StateSaved, "test"))
+	_, err = srv.CopyFile("b", f.ID, "b")
+	assert.ErrorIs(t, err, ErrNotOwner)
+
+	id, err := srv.CopyFile("a", f.ID, "b")
+	require.NoError(t, err)
+	cp, path, err := srv.File("b", id)
+	require.NoError(t, err)
+	assert.Equal(t, StateSaved, cp.State)
+	assert.Equal(t, f.Name, cp.Name)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestSpaceGuard(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	assert.Equal(t, HealthOK, srv.Health().Status)
+	stream, err := srv.pubsub.Subscribe(context.Background(), AdminTopic)
+	require.NoError(t, err)
+	defer stream.Unsubscribe()
+
+	srv.Config.MinFree = 1 << 40
+	_, err = srv.addFile(&File{Token: "t", State: StateReceived}, "test")
+	assert.ErrorIs(t, err, ErrInsufficientStorage)
+	var ev AdminEvent
+	select {
+	case msg := <-stream.Messages:
+		require.NoError(t, json.Unmarshal(msg.Payload, &ev))
+	case <-time.After(time.Second):
+		t.Fatal("admin event timeout")
+	}
+	assert.Equal(t, HealthDegraded, ev.State)
+	assert.Equal(t, HealthDegraded, srv.Health().Status)
+
+	srv.Config.MinFree = 0
+	_, err = srv.addFile(&File{Token: "t", State: StateReceived}, "test")
+	assert.NoError(t, err)
+	select {
+	case msg := <-stream.Messages:
+		require.NoError(t, json.Unmarshal(msg.Payload, &ev))
+	case <-time.After(time.Second):
+		t.Fatal("admin event timeout")
+	}
+	assert.Equal(t, HealthOK, ev.State)
+}
+
+func TestFileHistory(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	f := File{Token: "t", State: StateReceived}
+	_, err := srv.addFile(&f, "upload")
+	require.NoError(t, err)
+	require.NoError(t, srv.FileStateChange(f.ID, StateSaved, "upload saved"))
+	err = srv.FileStateChange(f.ID, StateReceived, "again")
+	assert.ErrorIs(t, err, ErrTransition)
+	var te TransitionError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, TransitionError{f.ID, StateSaved, StateReceived}, te)
+
+	history, err := srv.FileHistory("t", f.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, StateReceived, history[0].State)
+	assert.Equal(t, "upload", history[0].Reason)
+	assert.Equal(t, StateSaved, history[1].State)
+	assert.Equal(t, StateReceived, history[1].From)
+
+	_, err = srv.FileHistory("other", f.ID)
+	assert.ErrorIs(t, err, ErrNotOwner)
+}
+
+// fakeClamd serves INSTREAM command and finds "EICAR" in stream
+func fakeClamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				reply := "stream: OK\x00"
+				if bytes.Contains(data, []byte("EICAR")) {
+					reply = "stream: Eicar-Test-Signature FOUND\x00"
+				}
+				conn.Write([]byte(reply))
+			}(conn)
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	srv := newTestService(t, Config{
+		ScanAddr:       fakeClamd(t),
+		ScanTimeout:    time.Minute,
+		QuarantinePath: filepath.Join(t.TempDir(), "quarantine"),
+	})
+	defer srv.Close()
+	stream, err := srv.pubsub.Subscribe(context.Background(), "user.t")
+	require.NoError(t, err)
+	defer stream.Unsubscribe()
+	// do not block hub while FileStateChange publishes events
+	messages := make(chan pubsub.Message, 10)
+	go func() {
+		for msg := range stream.Messages {
+			messages <- msg
+		}
+	}()
+	go srv.HandlersRun()
+	defer srv.HandlersClose()
+	waitHandlers(t, srv)
+
+	tests := []struct {
+		data  string
+		state string
+	}{
+		{"clean data", "saved"},
+		{"EICAR data", "infected"},
+	}
+	for _, tt := range tests {
+		f := File{Token: "t", State: StateReceived}
+		path, err := srv.addFile(&f, "test")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte(tt.data), 0o644))
+		require.NoError(t, srv.FileStateChange(f.ID, srv.savedState(), "test"))
+		state := waitState(t, messages, f.ID)
+		if state == "scanning" {
+			state = waitState(t, messages, f.ID)
+		}
+		assert.Equal(t, tt.state, state, tt.data)
+		meta, _, err := srv.File("t", f.ID)
+		require.NoError(t, err)
+		require.NotNil(t, meta.Scan)
+		if tt.state == "infected" {
+			assert.Equal(t, "Eicar-Test-Signature", meta.Scan.Signature)
+			_, err = os.Stat(path)
+			assert.True(t, os.IsNotExist(err), "infected file must be moved")
+			_, err = os.Stat(filepath.Join(srv.Config.QuarantinePath, f.ID+".data"))
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestResumeScans(t *testing.T) {
+	// scanner accepts stream and never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			accepted <- struct{}{}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	srv := newTestService(t, Config{ScanAddr: "tcp://" + ln.Addr().String(), ScanTimeout: time.Minute})
+	defer srv.Close()
+	f := File{Token: "t", State: StateReceived}
+	path, err := srv.addFile(&f, "test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+	require.NoError(t, srv.FileStateChange(f.ID, StateScanning, "test"))
+
+	done := make(chan struct{})
+	go func() {
+		srv.HandlersRun()
+		close(done)
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan is not resumed")
+	}
+	srv.HandlersClose()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed scan is not canceled")
+	}
+	meta, _, err := srv.File("t", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StateScanning, meta.State, "canceled scan must be resumed on next start")
+}
+
+func TestResumeMeta(t *testing.T) {
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	// saved by recoverFiles before handlers subscription
+	f := File{ID: "0000001", Token: "t", State: StateSaved, CreatedAt: time.Now()}
+	require.NoError(t, srv.db.Update(func(txn *badger.Txn) error {
+		return setFileMeta(txn, &f)
+	}))
+	pdf := "%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n"
+	require.NoError(t, os.WriteFile(testDataFile(t, srv, &f), []byte(pdf), 0o644))
+	go srv.HandlersRun()
+	defer srv.HandlersClose()
+	require.Eventually(t, func() bool {
+		meta, _, err := srv.File("t", f.ID)
+		require.NoError(t, err)
+		return meta.Meta != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	meta, _, err := srv.File("t", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &Meta{PDF: &PDFMeta{Pages: 1}}, meta.Meta)
+}
+
+// waitHandlers waits for file topic subscription of HandlersRun
+func waitHandlers(t *testing.T, srv *Service) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		info, err := srv.pubsub.Info(context.Background())
+		require.NoError(t, err)
+		for _, ti := range info.Topics {
+			if ti.Topic == "file" && ti.Subscribers > 0 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("handlers subscription timeout")
+}
+
+// testJPEG returns jpeg header with EXIF (make, orientation, GPS) and 640x480 frame
+func testJPEG(t *testing.T) []byte {
+	be := binary.BigEndian
+	entry := func(b *bytes.Buffer, tag, typ uint16, count uint32, value []byte) {
+		require.NoError(t, binary.Write(b, be, struct {
+			Tag, Type uint16
+			Count     uint32
+		}{tag, typ, count}))
+		b.Write(append(value, make([]byte, 4-len(value))...))
+	}
+	u32 := func(v uint32) []byte { return be.AppendUint32(nil, v) }
+	rational := func(v ...uint32) []byte {
+		var rv []byte
+		for _, n := range v {
+			rv = be.AppendUint32(be.AppendUint32(rv, n), 1)
+		}
+		return rv
+	}
+	// IFD0 at 8 (42 bytes), make at 50, GPS IFD at 56 (54 bytes), lat at 110, lon at 134
+	var tf bytes.Buffer
+	tf.WriteString("MM\x00\x2a")
+	tf.Write(u32(8))
+	binary.Write(&tf, be, uint16(3))
+	entry(&tf, tagMake, 2, 6, u32(50))
+	entry(&tf, tagOrientation, 3, 1, []byte{0, 6})
+	entry(&tf, tagGPS, 4, 1, u32(56))
+	tf.Write(u32(0))
+	tf.WriteString("Canon\x00")
+	binary.Write(&tf, be, uint16(4))
+	entry(&tf, tagGPSLatRef, 2, 2, []byte("N\x00"))
+	entry(&tf, tagGPSLat, 5, 3, u32(110))
+	entry(&tf, tagGPSLonRef, 2, 2, []byte("W\x00"))
+	entry(&tf, tagGPSLon, 5, 3, u32(134))
+	tf.Write(u32(0))
+	tf.Write(rational(55, 45, 0))
+	tf.Write(rational(37, 37, 12))
+	require.Equal(t, 158, tf.Len())
+
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&b, be, uint16(2+len(exifHeader)+tf.Len()))
+	b.Write(exifHeader)
+	b.Write(tf.Bytes())
+	b.Write([]byte{0xFF, 0xC0, 0, 11, 8, 0x01, 0xE0, 0x02, 0x80, 1, 1, 0x11, 0})
+	b.Write([]byte{0xFF, 0xDA, 0, 2, 0xAA, 0xBB, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+func TestExtractMeta(t *testing.T) {
+	dir := t.TempDir()
+	// wav: 2 channels, 8000Hz, 16 bit, 2s
+	var wav bytes.Buffer
+	wav.WriteString("RIFF")
+	binary.Write(&wav, binary.LittleEndian, uint32(36+64000))
+	wav.WriteString("WAVEfmt ")
+	binary.Write(&wav, binary.LittleEndian, struct {
+		Size                 uint32
+		Format, Channels     uint16
+		SampleRate, ByteRate uint32
+		Align, Bits          uint16
+	}{16, 1, 2, 8000, 32000, 4, 16})
+	wav.WriteString("data")
+	binary.Write(&wav, binary.LittleEndian, uint32(64000))
+	wav.Write(make([]byte, 64000))
+	// mp3: ID3v2.3 tags and 128kbps 44100Hz stereo frames, 1s
+	var mp3, tags bytes.Buffer
+	tags.WriteString("TIT2\x00\x00\x00\x05\x00\x00\x00Song")
+	tags.WriteString("TPE1\x00\x00\x00\x05\x00\x00\x01\xFF\xFE\x41\x00")
+	mp3.WriteString("ID3\x03\x00\x00\x00\x00\x00")
+	mp3.WriteByte(byte(tags.Len()))
+	mp3.Write(tags.Bytes())
+	mp3.Write([]byte{0xFF, 0xFB, 0x90, 0x44})
+	mp3.Write(make([]byte, 16000-4))
+	pdf := "%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R >> endobj\n4 0 obj <</Type/Page/Parent 2 0 R>> endobj\n" +
+		"5 0 obj << /Title (Report \\(draft\\)) >> endobj\ntrailer << /Root 1 0 R /Info 5 0 R >>\n%%EOF\n"
+
+	tests := []struct {
+		name string
+		data []byte
+		want *Meta
+	}{
+		{"a.jpg", testJPEG(t), &Meta{Image: &ImageMeta{Width: 640, Height: 480, Orientation: 6, Make: "Canon",
+			GPS: &GPS{Lat: 55.75, Lon: -37.62}}}},
+		{"a.wav", wav.Bytes(), &Meta{Audio: &AudioMeta{Codec: "pcm", Duration: 2, SampleRate: 8000, Channels: 2, Bitrate: 256000}}},
+		{"a.mp3", mp3.Bytes(), &Meta{Audio: &AudioMeta{Codec: "mp3", Duration: 1, SampleRate: 44100, Channels: 2, Bitrate: 128000,
+			Title: "Song", Artist: "A"}}},
+		{"a.pdf", []byte(pdf), &Meta{PDF: &PDFMeta{Pages: 2, Title: "Report (draft)"}}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		require.NoError(t, os.WriteFile(path, tt.data, 0o644))
+		meta, err := ExtractMeta(path)
+		require.NoError(t, err, tt.name)
+		if tt.want.Image != nil {
+			assert.InDelta(t, tt.want.Image.GPS.Lat, meta.Image.GPS.Lat, 1e-6)
+			assert.InDelta(t, tt.want.Image.GPS.Lon, meta.Image.GPS.Lon, 1e-6)
+			meta.Image.GPS = tt.want.Image.GPS
+		}
+		assert.Equal(t, tt.want, meta, tt.name)
+	}
+	path := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(path, []byte("text"), 0o644))
+	_, err := ExtractMeta(path)
+	assert.ErrorIs(t, err, ErrNoMeta)
+	// ID3 tag size exceeds file size
+	path = filepath.Join(dir, "b.mp3")
+	require.NoError(t, os.WriteFile(path, []byte("ID3\x03\x00\x00\x7f\x7f\x7f\x7f\xFF\xFB\x90"), 0o644))
+	_, err = ExtractMeta(path)
+	assert.ErrorIs(t, err, ErrNoMeta)
+
+	// saved file meta
+	srv := newTestService(t, Config{})
+	defer srv.Close()
+	f := File{Name: "a.pdf", Token: "a", State: StateReceived}
+	dst, err := srv.addFile(&f, "test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, []byte(pdf), 0o644))
+	require.NoError(t, srv.extractMeta(f.ID))
+	saved, _, err := srv.File("a", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, tests[3].want, saved.Meta)
+
+	// broken content is not retried
+	f = File{Name: "b.jpg", Token: "a", State: StateReceived}
+	dst, err = srv.addFile(&f, "test")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, testJPEG(t)[:20], 0o644))
+	require.NoError(t, srv.extractMeta(f.ID))
+	saved, _, err = srv.File("a", f.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &Meta{}, saved.Meta)
+}
+
+func TestStripGPS(t *testing.T) {
+	src := testJPEG(t)
+	data, err := io.ReadAll(StripGPS(bytes.NewReader(src)))
+	require.NoError(t, err)
+	assert.Len(t, data, len(src))
+	meta, err := parseJPEG(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, &ImageMeta{Width: 640, Height: 480, Orientation: 6, Make: "Canon"}, meta)
+	// source is not changed
+	meta, err = parseJPEG(bytes.NewReader(src))
+	require.NoError(t, err)
+	assert.NotNil(t, meta.GPS)
+
+	data, err = io.ReadAll(StripGPS(strings.NewReader("text")))
+	require.NoError(t, err)
+	assert.Equal(t, "text", string(data))
+}
+
+func TestStripGPSMalformed(t *testing.T) {
+	// GPS IFD offset value of IFD0 third entry
+	pos := 6 + len(exifHeader) + 8 + 2 + 2*12 + 8
+	for _, offset := range []uint32{157, 158, 0xFFFFFFFF} {
+		src := testJPEG(t)
+		binary.BigEndian.PutUint32(src[pos:], offset)
+		data, err := io.ReadAll(StripGPS(bytes.NewReader(src)))
+		require.NoError(t, err)
+		assert.Equal(t, src, data, "offset %d", offset)
+		meta, err := parseJPEG(bytes.NewReader(src))
+		require.NoError(t, err)
+		assert.Nil(t, meta.GPS, "offset %d", offset)
+	}
+	// GPS IFD entry count exceeds data
+	src := testJPEG(t)
+	binary.BigEndian.PutUint16(src[6+len(exifHeader)+56:], 0xFFFF)
+	data, err := io.ReadAll(StripGPS(bytes.NewReader(src)))
+	require.NoError(t, err)
+	meta, err := parseJPEG(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Nil(t, meta.GPS)
+}
@@ -2,8 +2,12 @@
 package stream
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,6 +24,7 @@ type Config struct {
 	CookieName   string `long:"cookie" default:"sfs_auth" description:"Auth cookie name"`
 	HeaderName   string `long:"header" default:"X-SFS-Auth" description:"Auth header name"`
 	CookieMaxAge int    `long:"cookie_ttl" default:"3600" description:"Auth cookie TTL"`
+	AdminTopic   string `long:"admin_topic" default:"user.*" description:"Topic pattern streamed to admins"`
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
@@ -43,6 +48,14 @@ var (
 	// ErrNoAuth returned on Internal Server Error (no auth for upload)
 	ErrNoAuth       = errors.New("This endpoint must be under AuthRequired")
 	ErrNotSupported = errors.New("This ws call is not supported")
+	// ErrBadKey returned when request or token contains topic delimiter or wildcard
+	ErrBadKey = errors.New("bad request or token")
+)
+
+// Principal roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 // Service holds upload service
@@ -58,86 +71,245 @@ func New(cfg Config, logger *log.SugaredLogger, ps *pubsub.Service, key string)
 	return &Service{&cfg, logger, key, ps}
 }
 
+// principal returns request context with principal from auth token
+func (srv Service) principal(c *gin.Context, role string) (context.Context, error) {
+	tokenIface, _ := c.Get(srv.ContextKey)
+	if tokenIface == nil {
+		return nil, ErrNoAuth
+	}
+	p := pubsub.Principal{ID: tokenIface.(string), Role: role}
+	return pubsub.WithPrincipal(c.Request.Context(), p), nil
+}
+
+// subscribeError aborts request with status matching err
+func (srv Service) subscribeError(c *gin.Context, err error) {
+	srv.Log.Errorw("Failed to subscribe", "error", err)
+	status := http.StatusInternalServerError
+	if errors.Is(err, pubsub.ErrForbidden) {
+		status = http.StatusForbidden
+	}
+	c.AbortWithError(status, err)
+}
+
+// SetupRouter adds user stream handler. It must be called after AuthRequired setup
 func (srv Service) SetupRouter(r *gin.Engine) {
 	r.GET("/ws/:request/:key/", func(c *gin.Context) {
+		ctx, err := srv.principal(c, RoleUser)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 		reqID := c.Param("request")
 		token := c.Param("key")
-		if reqID == "" && token == "" {
-			c.AbortWithError(http.StatusNotImplemented, ErrNotSupported)
+		if strings.ContainsAny(reqID+token, ".*>") {
+			c.AbortWithError(http.StatusBadRequest, ErrBadKey)
 			return
 		}
-		var streams []pubsub.Stream
-		if token != "" {
-			stream, err := srv.pubsub.Subscribe("user." + token)
+		// client which passed last received offset gets missed messages
+		var opts []pubsub.SubscribeOption
+		mode := newWSMode(c)
+		if since := c.Query("since"); since != "" {
+			offset, err := strconv.ParseUint(since, 10, 64)
 			if err != nil {
-				srv.Log.Errorw("Failed to subscribe", "error", err)
+				c.AbortWithError(http.StatusBadRequest, err)
 				return
 			}
-			streams = append(streams, stream)
+			opts = append(opts, pubsub.FromOffset(offset+1))
+			mode.wrap = true
+		}
+		var topics []string
+		if token != "" {
+			topics = append(topics, "user."+token)
 		}
 		if reqID != "" && reqID != "-" {
-			stream, err := srv.pubsub.Subscribe("once.widget." + reqID)
-			if err != nil {
-				srv.Log.Errorw("Failed to subscribe", "error", err)
-				return
+			topics = append(topics, "once.widget."+reqID)
+		}
+		if len(topics) == 0 {
+			c.AbortWithError(http.StatusNotImplemented, ErrNotSupported)
+			return
+		}
+		// replay options are applied to first topic
+		stream, err := srv.pubsub.Subscribe(ctx, topics[0], opts...)
+		if err == nil {
+			if err = stream.Add(ctx, topics[1:]...); err != nil {
+				stream.Unsubscribe()
 			}
-			streams = append(streams, stream)
 		}
-		srv.wshandler(c.Writer, c.Request, streams)
+		if err != nil {
+			srv.subscribeError(c, err)
+			return
+		}
+		srv.wshandler(c.Writer, c.Request, stream, mode)
+	})
+}
+
+// SetupAdminRouter adds stream of all user events and pubsub state
+func (srv Service) SetupAdminRouter(r gin.IRoutes) {
+	r.GET("/api/pubsub", func(c *gin.Context) {
+		info, err := srv.pubsub.Info(c.Request.Context())
+		if err != nil {
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		c.JSON(http.StatusOK, info)
+	})
+	r.GET("/api/pubsub/dead", func(c *gin.Context) {
+		rv, err := srv.pubsub.DeadLetters(c.Request.Context())
+		if err != nil {
+			c.AbortWithError(deadLetterStatus(err), err)
+			return
+		}
+		c.JSON(http.StatusOK, rv)
+	})
+	r.POST("/api/pubsub/dead/:id/replay", func(c *gin.Context) {
+		if err := srv.pubsub.Replay(c.Request.Context(), c.Param("id")); err != nil {
+			c.AbortWithError(deadLetterStatus(err), err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.DELETE("/api/pubsub/dead/:id", func(c *gin.Context) {
+		if err := srv.pubsub.DeleteDeadLetter(c.Request.Context(), c.Param("id")); err != nil {
+			c.AbortWithError(deadLetterStatus(err), err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	r.GET("/ws/admin/", func(c *gin.Context) {
+		ctx, err := srv.principal(c, RoleAdmin)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		stream, err := srv.pubsub.Subscribe(ctx, srv.Config.AdminTopic)
+		if err != nil {
+			srv.subscribeError(c, err)
+			return
+		}
+		srv.wshandler(c.Writer, c.Request, stream, newWSMode(c))
 	})
 }
 
+// deadLetterStatus returns http status of dead letter call error
+func deadLetterStatus(err error) int {
+	switch {
+	case errors.Is(err, pubsub.ErrNoDeadLetter):
+		return http.StatusNotFound
+	case errors.Is(err, pubsub.ErrNoStore):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 var wsupgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func (srv Service) wshandler(w http.ResponseWriter, r *http.Request, streams []pubsub.Stream) {
-	conn, err := wsupgrader.Upgrade(w, r, nil)
+// wsMessage holds message with its durable log offset and envelope
+type wsMessage struct {
+	Offset    uint64            `json:"offset,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Time      *time.Time        `json:"time,omitempty"`
+	Publisher string            `json:"publisher,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Data      interface{}       `json:"data"`
+}
+
+// wsMode holds message format of ws connection
+type wsMode struct {
+	// wrap sends data with offset
+	wrap bool
+	// envelope sends data with message envelope
+	envelope bool
+}
+
+// wsCodecs holds codecs which can encode any message payload.
+// Protobuf needs message type, so it is not negotiated
+var wsCodecs = map[string]bool{pubsub.CodecJSON: true, pubsub.CodecMsgPack: true}
+
+// wsCodec returns codec of first supported subprotocol requested by client.
+// JSON returned with empty header if there is no such subprotocol
+func wsCodec(r *http.Request) (pubsub.Codec, http.Header) {
+	for _, name := range websocket.Subprotocols(r) {
+		if !wsCodecs[name] {
+			continue
+		}
+		if codec, err := pubsub.CodecByName(name); err == nil {
+			return codec, http.Header{"Sec-Websocket-Protocol": {name}}
+		}
+	}
+	return pubsub.JSON{}, nil
+}
+
+// newWSMode returns message format requested by client
+func newWSMode(c *gin.Context) wsMode {
+	envelope, _ := strconv.ParseBool(c.Query("envelope"))
+	return wsMode{envelope: envelope}
+}
+
+// wsPayload returns message payload encoded by codec, wrapped with offset and envelope if mode requires
+func wsPayload(msg pubsub.Message, mode wsMode, codec pubsub.Codec) ([]byte, error) {
+	data, err := pubsub.Transcode(msg, codec)
+	if err != nil || !(mode.wrap || mode.envelope) {
+		return data, err
+	}
+	rv := wsMessage{Offset: msg.Offset, Data: json.RawMessage(data)}
+	if mode.envelope {
+		rv.ID, rv.Topic, rv.Publisher, rv.Headers = msg.ID, msg.Topic, msg.Publisher, msg.Headers
+		if !msg.Time.IsZero() {
+			rv.Time = &msg.Time
+		}
+	}
+	if codec.Name() != pubsub.CodecJSON {
+		var v interface{}
+		if err = codec.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		rv.Data = v
+	}
+	return codec.Marshal(rv)
+}
+
+func (srv Service) wshandler(w http.ResponseWriter, r *http.Request, stream pubsub.Stream, mode wsMode) {
+	defer stream.Unsubscribe()
+	codec, header := wsCodec(r)
+	conn, err := wsupgrader.Upgrade(w, r, header)
 	if err != nil {
 		srv.Log.Errorw("Failed to set websocket upgrade", "error", err)
 		return
 	}
+	// JSON is sent in text frames, other codecs in binary
+	frame := websocket.BinaryMessage
+	if codec.Name() == pubsub.CodecJSON {
+		frame = websocket.TextMessage
+	}
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		conn.Close()
 	}()
 
-	for _, s := range streams {
-		defer s.Unsubscribe()
-	}
-	if len(streams) == 1 {
-		streams = append(streams, pubsub.Stream{Messages: make(chan pubsub.Message)}) //fake channel for switch
-	}
-	//	srv.Log.Debugw("Subscribed on", "prefix", "user", "topic", token)
 	for {
 		select {
-		case msg, ok := <-streams[0].Messages:
+		case msg, ok := <-stream.Messages:
 			if !ok {
 				// Channel closed,exit
 				srv.Log.Debugw("Subscription closed")
 				conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			srv.Log.Debugw("Received event", "data", string(msg.Payload))
-			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err = conn.WriteMessage(websocket.TextMessage, msg.Payload)
+			srv.Log.Debugw("Received event", "topic", msg.Topic, "id", msg.ID, "request", msg.Headers[pubsub.HeaderRequestID],
+				"codec", msg.Codec, "size", len(msg.Payload))
+			data, err := wsPayload(msg, mode, codec)
 			if err != nil {
-				srv.Log.Warnw("Failed to send ws message", "error", err)
-				return
-			}
-		case msg, ok := <-streams[1].Messages:
-			if !ok {
-				// Channel closed,exit
-				srv.Log.Debugw("Subscription closed")
-				conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+				srv.Log.Warnw("Failed to encode ws message", "topic", msg.Topic, "codec", codec.Name(), "error", err)
+				continue
 			}
-			srv.Log.Debugw("Received event", "data", string(msg.Payload))
 			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err = conn.WriteMessage(websocket.TextMessage, msg.Payload)
+			err = conn.WriteMessage(frame, data)
 			if err != nil {
 				srv.Log.Warnw("Failed to send ws message", "error", err)
 				return
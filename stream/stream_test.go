@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	log "go.uber.org/zap"
+
+	"github.com/LeKovr/sfs/pubsub"
+)
+
+// newTestRouter returns router of user stream with auth token "t"
+func newTestRouter(t *testing.T) (*gin.Engine, *pubsub.Service) {
+	l := log.NewNop().Sugar()
+	ps, err := pubsub.New(pubsub.Config{}, l)
+	require.NoError(t, err)
+	go ps.Run()
+	t.Cleanup(ps.Close)
+	srv := New(Config{}, l, ps, "token")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("token", "t") })
+	srv.SetupRouter(r)
+	return r, ps
+}
+
+func TestWSNoTopics(t *testing.T) {
+	r, _ := newTestRouter(t)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ws/-//", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestWSCodec(t *testing.T) {
+	r, ps := newTestRouter(t)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/-/t/"
+
+	tests := []struct {
+		request  []string
+		protocol string
+		frame    int
+	}{
+		// protobuf can not encode decoded payload, so JSON is used
+		{[]string{pubsub.CodecProtobuf}, "", websocket.TextMessage},
+		{[]string{pubsub.CodecProtobuf, pubsub.CodecMsgPack}, pubsub.CodecMsgPack, websocket.BinaryMessage},
+	}
+	for _, tt := range tests {
+		d := websocket.Dialer{Subprotocols: tt.request}
+		conn, _, err := d.Dial(url, nil)
+		require.NoError(t, err)
+		assert.Equal(t, tt.protocol, conn.Subprotocol())
+		require.NoError(t, ps.Publish(context.Background(), "user.t", map[string]int{"a": 1}))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, data, err := conn.ReadMessage()
+		require.NoError(t, err, tt.request)
+		assert.Equal(t, tt.frame, frame)
+		codec, err := pubsub.CodecByName(tt.protocol)
+		require.NoError(t, err)
+		var v map[string]float64
+		require.NoError(t, codec.Unmarshal(data, &v))
+		assert.Equal(t, map[string]float64{"a": 1}, v)
+		conn.Close()
+	}
+}
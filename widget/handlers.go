@@ -1,7 +1,10 @@
 package widget
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/LeKovr/sfs/pubsub"
@@ -14,43 +17,93 @@ type WidgetEvent struct {
 }
 
 func (srv Service) HandlersRun() {
-
-	stream, err := srv.pubsub.Subscribe("widget")
-	if err != nil {
-		srv.Log.Errorw("Failed to subscribe", "error", err)
-		return
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-srv.quit
+		cancel()
+	}()
+	srv.Log.Debugw("Subscribe on widget")
+	err := pubsub.Handle(ctx, srv.pubsub, "widget", srv.handleEvent, pubsub.Queue("widget"))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		srv.Log.Errorw("Widget handler error", "error", err)
 	}
-	defer stream.Unsubscribe()
+	srv.Log.Debugw("Subscription closed")
+}
 
-	srv.Log.Debugw("Subscribed on widget")
-	for {
-		select {
-		case msg, ok := <-stream.Messages:
-			if !ok {
-				// Channel closed,exit
-				srv.Log.Debugw("Subscription closed")
-				return
-			}
-			srv.Log.Debugw("Received event", "data", string(msg.Payload))
+// sentWidgets holds names of widgets published by page event ID
+type sentWidgets struct {
+	mu sync.Mutex
+	m  map[string]map[string]bool
+}
 
-			var req PageEvent
-			pubsub.Unmarshal(msg.Payload, &req)
-			// Layout depended list
-			go srv.widgetPrepare(req, "top")
-			go srv.widgetPrepare(req, "navy")
-			go srv.widgetPrepare(req, "menu")
-			// Process
-		case <-srv.quit:
-			break
+// pending returns names which were not published for event id
+func (sw *sentWidgets) pending(id string, names []string) []string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	var rv []string
+	for _, name := range names {
+		if !sw.m[id][name] {
+			rv = append(rv, name)
 		}
 	}
+	return rv
+}
+
+// add marks widget as published for event id
+func (sw *sentWidgets) add(id, name string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.m[id] == nil {
+		sw.m[id] = map[string]bool{}
+	}
+	sw.m[id][name] = true
+}
+
+// done forgets event id
+func (sw *sentWidgets) done(id string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	delete(sw.m, id)
+}
+
+// handleEvent prepares page widgets concurrently.
+// Retry publishes only widgets which were failed before
+func (srv Service) handleEvent(ctx context.Context, ev pubsub.Event[PageEvent]) error {
+	req := ev.Value
+	srv.Log.Debugw("Received event", "request", req.RequestID, "layout", req.Layout)
+	id := ev.ID
+	if id == "" {
+		id = req.RequestID
+	}
+	// Layout depended list
+	names := srv.sent.pending(id, []string{"top", "navy", "menu"})
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			err := srv.widgetPrepare(ctx, req, name)
+			if err == nil {
+				srv.sent.add(id, name)
+			}
+			errs <- err
+		}(name)
+	}
+	var rv []error
+	for range names {
+		rv = append(rv, <-errs)
+	}
+	err := errors.Join(rv...)
+	if err == nil || pubsub.LastAttempt(ctx) || ctx.Err() != nil {
+		srv.sent.done(id)
+	}
+	return err
 }
 
 func (srv Service) HandlersClose() {
 	close(srv.quit)
 }
 
-func (srv Service) widgetPrepare(req PageEvent, name string) {
+func (srv Service) widgetPrepare(ctx context.Context, req PageEvent, name string) error {
 
 	var demoSleep = map[string]int{
 		"menu": 2,
@@ -60,9 +113,9 @@ func (srv Service) widgetPrepare(req PageEvent, name string) {
 	if ok {
 		time.Sleep(time.Duration(s) * time.Second) // эмуляция процесса
 	}
-	if err := srv.pubsub.Publish("once.widget."+req.RequestID,
+	if err := srv.pubsub.Publish(ctx, "once.widget."+req.RequestID,
 		WidgetEvent{"widget", name, fmt.Sprintf("<h2>rendered %s</h2>", name)}); err != nil {
-		srv.Log.Errorw("Widget event publish error", "name", name, "error", err)
-		return
+		return fmt.Errorf("widget %s publish: %w", name, err)
 	}
+	return nil
 }
@@ -43,6 +43,8 @@ type Service struct {
 	ContextRequestIDKey string
 	pubsub              *pubsub.Service
 	quit                chan struct{}
+	// sent holds widgets published by retried page events
+	sent *sentWidgets
 }
 
 // New creates an Service object
@@ -54,6 +56,7 @@ func New(cfg Config, logger *log.SugaredLogger, ps *pubsub.Service, key, idKey s
 		ContextRequestIDKey: idKey,
 		pubsub:              ps,
 		quit:                make(chan struct{}),
+		sent:                &sentWidgets{m: map[string]map[string]bool{}},
 	}
 }
 
@@ -74,6 +77,10 @@ func (srv Service) RequestID() func(c *gin.Context) {
 		requestID := u.String()
 		c.Set(srv.ContextRequestIDKey, requestID)
 		srv.Log.Debugw("RequestID", "id", requestID)
+		// messages published with request context carry its IDs
+		ctx := pubsub.WithHeader(c.Request.Context(), pubsub.HeaderRequestID, requestID)
+		ctx = pubsub.WithHeader(ctx, pubsub.HeaderTraceParent, c.GetHeader(pubsub.HeaderTraceParent))
+		c.Request = c.Request.WithContext(ctx)
 
 		// Continue down the chain to handler etc
 		c.Next()
@@ -99,7 +106,7 @@ func (srv Service) WidgetJS() func(c *gin.Context) {
 			return
 		}
 
-		err := srv.pubsub.Publish("widget", PageEvent{reqID, layout})
+		err := srv.pubsub.Publish(c.Request.Context(), "widget", PageEvent{reqID, layout})
 		if err != nil {
 			srv.Log.Errorw("Widget event publish error", "error", err)
 			return